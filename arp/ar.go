@@ -1,7 +1,9 @@
 package arp
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -28,6 +30,16 @@ var ErrCorruptedHash = errors.New("corrupted file")
 
 var ErrInvalidHeader = errors.New("invalid magic header")
 
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+var ErrEndianness = errors.New("unmatched endianness")
+
+// ErrCorruptedIndex indicates the header points to an index which can't be there, or the index is inconsistent
+var ErrCorruptedIndex = errors.New("corrupted index")
+
+// ErrDuplicatePath indicates the path has been written to the archive already
+var ErrDuplicatePath = errors.New("duplicate path")
+
 const (
 	DirGUID  = "\xd8\x4d\xd3\xd0\x67\x09\x43\x64\x98\x19\x3f\x6e\x61\x4c\x2f\xd4\xd8\x4d\xd3\xd0\x67\x09\x43\x64\x98\x19\x3f\x6e\x61\x4c\x2f\xd4"
 	MetaSize = 24
@@ -38,9 +50,13 @@ const (
 type EntryInfo struct {
 	Path    string
 	Modtime time.Time
+	Atime   time.Time // equals Modtime in v1 archives
+	Ctime   time.Time // equals Modtime in v1 archives
 	Hash    [sha256.Size]byte
 	Mode    uint32
 	IsDir   bool
+	Codec   Codec
+	Size    int64 // the original size, the stored size is in the jmptable
 	score   byte
 }
 
@@ -50,10 +66,16 @@ type Archive struct {
 	Cursor   *Uint64OneTwoMap
 	Size     int64
 	Path     string
-	pathhash map[uint64]*EntryInfo
+	infos    map[string]*EntryInfo
 	Info     os.FileInfo
 	Created  time.Time
 	Password string
+	Version  int    // 1 for zzz0 archives
+	Flags    uint32 // optional features, always 0 in v1 archives
+	entries  []*EntryInfo
+	keys     *archiveKeys
+	tree     map[string]*fsNode
+	sig      []byte // the signature block if FlagSigned
 }
 
 // DumpArchiveJmpTable dumps the header
@@ -81,29 +103,112 @@ func DumpArchiveJmpTable(path, dumppath string) error {
 
 func DumpArchiveJmpTableBytes(ar io.Reader) ([]byte, error) {
 	cursor := &Uint64OneTwoMap{}
-	p := [MetaSize]byte{}
-	if _, err := ar.Read(p[:]); err != nil {
+	p := make([]byte, HeaderV2Size)
+	if _, err := io.ReadFull(ar, p[:MetaSize]); err != nil {
 		return nil, err
 	}
-	if string(p[:4]) != Header {
-		return nil, ErrInvalidHeader
-	}
 
-	count := binary.BigEndian.Uint32(p[4:8])
-	if p[12] != *(*byte)(unsafe.Pointer(&One)) {
-		return nil, fmt.Errorf("unmatched endianness")
+	var count uint32
+	switch string(p[:4]) {
+	case Header:
+		count = binary.BigEndian.Uint32(p[4:8])
+		if p[12] != *(*byte)(unsafe.Pointer(&One)) {
+			return nil, ErrEndianness
+		}
+		p = p[:MetaSize]
+	case HeaderV2:
+		h := headerV2{}
+		r, _, err := readIndexV2(ar, p, &h, "")
+		if err != nil {
+			return nil, err
+		}
+		ar, count = r, h.count
+	default:
+		return nil, ErrInvalidHeader
 	}
 
 	cursor.Data = make([][3]uint64, count)
-	if _, err := ar.Read(cursor.Bytes()); err != nil {
+	if _, err := io.ReadFull(ar, cursor.Bytes()); err != nil {
 		return nil, err
 	}
 
-	return append(p[:], cursor.Bytes()...), nil
+	return append(p, cursor.Bytes()...), nil
+}
+
+// readIndexV2 reads the rest of the v2 header (the first MetaSize bytes are already in p),
+// and returns the reader of the jmptable and metadata, which are decrypted if needed
+func readIndexV2(ar io.Reader, p []byte, h *headerV2, password string) (io.Reader, *archiveKeys, error) {
+	rs, ok := ar.(io.ReadSeeker)
+	if !ok {
+		return nil, nil, errors.New("v2 archives can only be read from an io.ReadSeeker")
+	}
+	if _, err := io.ReadFull(rs, p[MetaSize:HeaderV2Size]); err != nil {
+		return nil, nil, err
+	}
+	if err := h.unmarshal(p); err != nil {
+		return nil, nil, err
+	}
+	// check the header before allocating anything by it
+	pos, err := rs.Seek(0, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := rs.Seek(0, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.indexOffset > uint64(end) || h.indexSize > uint64(end)-h.indexOffset || uint64(h.count)*MetaSize > h.indexSize {
+		return nil, nil, ErrCorruptedIndex
+	}
+	if h.flags&FlagSigned != 0 {
+		if h.sigOffset > uint64(end) || uint64(end)-h.sigOffset < sigBlockSize {
+			return nil, nil, ErrCorruptedIndex
+		}
+		h.signature = make([]byte, sigBlockSize)
+		if _, err := rs.Seek(int64(h.sigOffset), 0); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.ReadFull(rs, h.signature); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err := rs.Seek(pos, 0); err != nil {
+		return nil, nil, err
+	}
+
+	var keys *archiveKeys
+	if h.flags&FlagEncrypted != 0 {
+		kb := make([]byte, keyBlockSize)
+		if _, err := io.ReadFull(rs, kb); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if keys, err = openKeyBlock(kb, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if _, err := rs.Seek(int64(h.indexOffset), 0); err != nil {
+		return nil, nil, err
+	}
+	if keys == nil {
+		return rs, nil, nil
+	}
+
+	sealed := make([]byte, h.indexSize)
+	if _, err := io.ReadFull(rs, sealed); err != nil {
+		return nil, nil, err
+	}
+	index, err := openIndex(keys.meta, sealed, indexAD(*h))
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(index), keys, nil
 }
 
-// OpenArchive opens an archive with the given path
-func OpenArchive(path string, password string, jmpTableOnly bool) (*Archive, error) {
+// OpenArchive opens an archive with the given path. If trusted keys are given, the archive
+// must be signed by one of them, otherwise it's rejected, see Verify
+func OpenArchive(path string, password string, jmpTableOnly bool, trusted ...ed25519.PublicKey) (*Archive, error) {
 	ar, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -122,6 +227,12 @@ func OpenArchive(path string, password string, jmpTableOnly bool) (*Archive, err
 	x.Size = st.Size()
 	x.Path = path
 	x.Info = st
+	if len(trusted) > 0 {
+		if err := x.VerifyAny(trusted); err != nil {
+			ar.Close()
+			return nil, err
+		}
+	}
 	return x, nil
 }
 
@@ -132,18 +243,23 @@ func OpenArchiveBytes(ar io.Reader, password string, jmpTableOnly bool) (*Archiv
 		Password: password,
 	}
 
-	p := [MetaSize]byte{}
-	if _, err := ar.Read(p[:]); err != nil {
+	p := [HeaderV2Size]byte{}
+	if _, err := io.ReadFull(ar, p[:MetaSize]); err != nil {
 		return nil, err
 	}
+	if string(p[:4]) == HeaderV2 {
+		return x, x.openV2(ar, p[:], jmpTableOnly)
+	}
 	if string(p[:4]) != Header {
 		return nil, ErrInvalidHeader
 	}
 
+	x.Version = 1
+	x.Cursor.Legacy = true
 	count := binary.BigEndian.Uint32(p[4:8])
 	x.Created = time.Unix(int64(binary.BigEndian.Uint32(p[8:12])), 0)
 	if p[12] != *(*byte)(unsafe.Pointer(&One)) {
-		return nil, fmt.Errorf("unmatched endianness")
+		return nil, ErrEndianness
 	}
 
 	x.Cursor.Data = make([][3]uint64, count)
@@ -155,7 +271,7 @@ func OpenArchiveBytes(ar io.Reader, password string, jmpTableOnly bool) (*Archiv
 		return x, nil
 	}
 
-	x.pathhash = make(map[uint64]*EntryInfo)
+	x.infos = make(map[string]*EntryInfo)
 	pathbuf := make([]byte, 256)
 	for i := uint32(0); i < count; i++ {
 		if _, err := ar.Read(p[:2]); err != nil {
@@ -181,6 +297,7 @@ func OpenArchiveBytes(ar io.Reader, password string, jmpTableOnly bool) (*Archiv
 			return nil, err
 		}
 		fi.Modtime = time.Unix(int64(binary.BigEndian.Uint32(pathbuf)), 0)
+		fi.Atime, fi.Ctime = fi.Modtime, fi.Modtime
 
 		if _, err := ar.Read(pathbuf[:sha256.Size]); err != nil {
 			return nil, err
@@ -193,12 +310,89 @@ func OpenArchiveBytes(ar io.Reader, password string, jmpTableOnly bool) (*Archiv
 		}
 
 		fi.Path = string(x.DecodeBytes(pathbuf[:pathlen]))
-		x.pathhash[fnv64Sum(fi.Path)] = fi
+		x.infos[fi.Path] = fi
+		x.entries = append(x.entries, fi)
 	}
 
+	x.Cursor.linkPaths(x.entries)
+	x.fillSizes()
+	x.buildTree()
 	return x, nil
 }
 
+func (x *Archive) openV2(ar io.Reader, p []byte, jmpTableOnly bool) error {
+	h := headerV2{}
+	ar, keys, err := readIndexV2(ar, p, &h, x.Password)
+	if err != nil {
+		return err
+	}
+
+	x.keys = keys
+	x.sig = h.signature
+	x.Version = int(h.version)
+	x.Flags = h.flags
+	x.Created = fromUnixNano(h.created)
+
+	x.Cursor.Legacy = h.flags&FlagPathRefs == 0
+	x.Cursor.Data = make([][3]uint64, h.count)
+	if _, err := io.ReadFull(ar, x.Cursor.Bytes()); err != nil {
+		return err
+	}
+
+	if jmpTableOnly {
+		return nil
+	}
+
+	x.infos = make(map[string]*EntryInfo, h.count)
+	x.entries = make([]*EntryInfo, h.count)
+	r := bufio.NewReader(ar)
+	for i := range x.entries {
+		fi := &EntryInfo{}
+		path, err := readEntryV2(r, fi, h.flags)
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			path = x.DecodeBytes(path)
+		}
+		fi.Path = string(path)
+		x.infos[fi.Path] = fi
+		x.entries[i] = fi
+	}
+
+	if h.flags&FlagPathRefs == 0 {
+		x.Cursor.linkPaths(x.entries)
+	} else {
+		refs := make([]byte, 4*h.count)
+		if _, err := io.ReadFull(r, refs); err != nil {
+			return err
+		}
+		x.Cursor.Paths = make([]string, h.count)
+		for i := range x.Cursor.Paths {
+			ref := binary.BigEndian.Uint32(refs[i*4:])
+			if ref >= h.count {
+				return ErrCorruptedIndex
+			}
+			x.Cursor.Paths[i] = x.entries[ref].Path
+		}
+	}
+	x.fillSizes()
+	x.buildTree()
+	return nil
+}
+
+// fillSizes sets the original sizes of entries in archives without codecs
+func (x *Archive) fillSizes() {
+	if x.Flags&FlagCodecs != 0 {
+		return
+	}
+	for _, fi := range x.entries {
+		if _, l, ok := x.GetFile(fi.Path); ok {
+			fi.Size = int64(l)
+		}
+	}
+}
+
 func (a *Archive) DecodeBytes(in []byte) []byte {
 	buf, _ := ioutil.ReadAll(WrapReaderWriter(bytes.NewReader(in), nil, a.Password))
 	return buf
@@ -239,7 +433,8 @@ func (a *Archive) Contains(path string) bool {
 	return ok
 }
 
-// Stream streams the given file into w
+// Stream streams the given file into w, compressed entries are decompressed.
+// Reads are positional, so it's safe to stream from many goroutines at once
 func (a *Archive) Stream(w io.Writer, path string) (int64, error) {
 	start, length, ok := a.Cursor.Get(path)
 	if !ok {
@@ -249,8 +444,14 @@ func (a *Archive) Stream(w io.Writer, path string) (int64, error) {
 		return 0, fmt.Errorf("%s is a bad file", path)
 	}
 
-	if _, err := a.Fd.Seek(int64(start), 0); err != nil {
-		return 0, err
+	r := io.NewSectionReader(a.Fd, int64(start), int64(length))
+	if a.Flags&FlagCodecs != 0 {
+		fi, ok := a.GetInfo(path)
+		if !ok {
+			// opened with jmpTableOnly, the codec is unknown
+			return 0, fmt.Errorf("can't decode %s without metadata", path)
+		}
+		return a.streamDecoded(w, fi, r, int64(length))
 	}
 
 	var wr int64
@@ -258,12 +459,12 @@ func (a *Archive) Stream(w io.Writer, path string) (int64, error) {
 
 	w = WrapReaderWriter(nil, w, a.Password)
 
-	if a.pathhash == nil {
-		wr, err = io.CopyN(w, a.Fd, int64(length))
+	if a.infos == nil {
+		wr, err = io.CopyN(w, r, int64(length))
 	} else {
 		var h []byte
-		wr, h, err = HashCopyN(w, a.Fd, int64(length))
-		if !bytes.Equal(h, a.pathhash[fnv64Sum(path)].Hash[:]) {
+		wr, h, err = HashCopyN(w, r, int64(length))
+		if !bytes.Equal(h, a.infos[path].Hash[:]) {
 			return wr, ErrCorruptedHash
 		}
 	}
@@ -277,24 +478,79 @@ func (a *Archive) Stream(w io.Writer, path string) (int64, error) {
 	return wr, nil
 }
 
+// streamDecoded decrypts and decompresses the stored bytes of the entry, the hash covers
+// the original content
+func (a *Archive) streamDecoded(w io.Writer, fi *EntryInfo, stored io.Reader, length int64) (int64, error) {
+	var src io.Reader = stored
+	if a.keys != nil {
+		or, err := newOpenReader(src, a.keys, length)
+		if err != nil {
+			return 0, err
+		}
+		src = or
+	} else {
+		src = WrapReaderWriter(src, nil, a.Password)
+	}
+
+	r, err := decompressor(fi.Codec, src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	wr, h, err := HashCopy(w, r)
+	if err != nil {
+		return wr, err
+	}
+	if wr != fi.Size || !bytes.Equal(h, fi.Hash[:]) {
+		return wr, ErrCorruptedHash
+	}
+	return wr, nil
+}
+
+// ContentHash returns the sha256 of the content of the file at path. It's the stored hash,
+// except for encrypted v1 archives whose hash covers the encrypted bytes, then the file is read
+func (a *Archive) ContentHash(path string) ([sha256.Size]byte, error) {
+	fi, ok := a.GetInfo(path)
+	if !ok {
+		return [sha256.Size]byte{}, fmt.Errorf("%s not found", path)
+	}
+	if a.Flags&FlagCodecs != 0 || a.Password == "" {
+		return fi.Hash, nil
+	}
+
+	h := sha256.New()
+	if _, err := a.Stream(h, path); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Entries returns the entries in the order of archiving, nil if the archive is opened with jmpTableOnly
+func (a *Archive) Entries() []*EntryInfo {
+	return a.entries
+}
+
 func (a *Archive) TotalEntries() int {
 	return len(a.Cursor.Data)
 }
 
 // GetInfo returns the basic info of a file in a fast way
 func (a *Archive) GetInfo(path string) (info *EntryInfo, ok bool) {
-	if a.pathhash == nil {
-		return nil, false
-	}
-	h := fnv64Sum(path)
-	fi, ok := a.pathhash[h]
+	fi, ok := a.infos[path]
 	return fi, ok
 }
 
 // Iterate iterates through files in the archive
 func (a *Archive) Iterate(cb func(*EntryInfo, uint64, uint64) error) error {
-	for _, x := range a.Cursor.Data {
-		y := a.pathhash[x[0]]
+	for i, x := range a.Cursor.Data {
+		y := a.infos[a.Cursor.Paths[i]]
+		if y == nil {
+			// errored entries of v1 archives have no metadata
+			continue
+		}
 		if y.IsDir {
 			x[1], x[2] = 0, 0
 		}
@@ -305,10 +561,20 @@ func (a *Archive) Iterate(cb func(*EntryInfo, uint64, uint64) error) error {
 	return nil
 }
 
+// Uint64OneTwoMap is the jmptable: [hash of path, start, length] sorted by hash
 type Uint64OneTwoMap struct {
 	Data [][3]uint64
+	// Paths holds the full path of every row, when set, Get verifies the path on hit
+	// and probes all rows with the same hash
+	Paths []string
+	// Legacy uses fnv64Sum of v1 archives instead of pathHash
+	Legacy bool
+	// order[i] is the position where row i was pushed, set by Seal
+	order []int
 }
 
+// fnv64Sum is the hash of archives without FlagPathRefs, note that it starts from 0
+// and hashes runes rather than bytes
 func fnv64Sum(data string) uint64 {
 	const prime64 = 1099511628211
 	var hash uint64
@@ -319,13 +585,35 @@ func fnv64Sum(data string) uint64 {
 	return hash
 }
 
+// fnv1a64 is the standard 64-bit FNV-1a
+func fnv1a64(data string) uint64 {
+	const offset64, prime64 = 14695981039346656037, 1099511628211
+	var hash uint64 = offset64
+	for i := 0; i < len(data); i++ {
+		hash ^= uint64(data[i])
+		hash *= prime64
+	}
+	return hash
+}
+
+// pathHash hashes paths in the jmptable, it's a variable so tests can force collisions
+var pathHash = fnv1a64
+
+func (m *Uint64OneTwoMap) hash(k string) uint64 {
+	if m.Legacy {
+		return fnv64Sum(k)
+	}
+	return pathHash(k)
+}
+
 func (m *Uint64OneTwoMap) Len() int { return len(m.Data) }
 
 func (m *Uint64OneTwoMap) Push(k string, v, l uint64) {
 	if m.Data == nil {
 		m.Data = make([][3]uint64, 0)
 	}
-	m.Data = append(m.Data, [3]uint64{fnv64Sum(k), v, l})
+	m.Data = append(m.Data, [3]uint64{m.hash(k), v, l})
+	m.Paths = append(m.Paths, k)
 }
 
 func (m *Uint64OneTwoMap) Bytes() []byte {
@@ -341,26 +629,67 @@ func (m *Uint64OneTwoMap) Bytes() []byte {
 	return *(*[]byte)(unsafe.Pointer(&r))
 }
 
+// Seal sorts the rows by hash, then by path
 func (m *Uint64OneTwoMap) Seal() {
-	sort.Slice(m.Data, func(i, j int) bool {
-		return m.Data[i][0] < m.Data[j][0]
+	order := make([]int, len(m.Data))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := m.Data[order[i]], m.Data[order[j]]
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		return m.Paths[order[i]] < m.Paths[order[j]]
 	})
+
+	data, paths := make([][3]uint64, len(m.Data)), make([]string, len(m.Data))
+	for i, o := range order {
+		data[i], paths[i] = m.Data[o], m.Paths[o]
+	}
+	m.Data, m.Paths, m.order = data, paths, order
 }
 
 func (m *Uint64OneTwoMap) Get(key string) (uint64, uint64, bool) {
-	var start, end, k uint64 = 0, uint64(len(m.Data)), fnv64Sum(key)
-AGAIN:
-	if start >= end {
-		return 0, 0, false
-	}
-	mid := (start + end) / 2
-	if x := m.Data[mid]; k == x[0] {
-		return x[1], x[2], true
-	} else if k < x[0] {
-		end = mid
-		goto AGAIN
-	} else {
-		start = mid + 1
-		goto AGAIN
+	if i := m.find(key); i >= 0 {
+		return m.Data[i][1], m.Data[i][2], true
+	}
+	return 0, 0, false
+}
+
+// linkPaths fills Paths of a jmptable without path references by matching hashes,
+// rows without metadata are left empty
+func (m *Uint64OneTwoMap) linkPaths(entries []*EntryInfo) {
+	byHash := map[uint64][]string{}
+	for _, fi := range entries {
+		h := m.hash(fi.Path)
+		byHash[h] = append(byHash[h], fi.Path)
+	}
+
+	m.Paths = make([]string, len(m.Data))
+	for i, x := range m.Data {
+		if p := byHash[x[0]]; len(p) > 0 {
+			m.Paths[i], byHash[x[0]] = p[0], p[1:]
+		}
+	}
+}
+
+// find returns the row of key, -1 if not found
+func (m *Uint64OneTwoMap) find(key string) int {
+	k := m.hash(key)
+	i := sort.Search(len(m.Data), func(i int) bool { return m.Data[i][0] >= k })
+	if m.Paths == nil {
+		// without paths, trust the hash
+		if i < len(m.Data) && m.Data[i][0] == k {
+			return i
+		}
+		return -1
+	}
+	for ; i < len(m.Data) && m.Data[i][0] == k; i++ {
+		// rows of legacy archives without metadata can only be matched by hash
+		if m.Paths[i] == key || m.Legacy && m.Paths[i] == "" {
+			return i
+		}
 	}
+	return -1
 }
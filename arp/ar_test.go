@@ -0,0 +1,1166 @@
+package arp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenV1(t *testing.T) {
+	a, err := OpenArchive("testdata/v1.arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if a.Version != 1 || a.TotalEntries() != 4 {
+		t.Fatal("unexpected archive:", a.Version, a.TotalEntries())
+	}
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		path, content string
+		dir           bool
+	}{{".", "", true}, {"a.txt", "hello", false}, {"sub", "", true}, {"sub/b.txt", "world!", false}} {
+		fi, ok := a.GetInfo(c.path)
+		if !ok {
+			t.Fatal(c.path, "not found")
+		}
+		if fi.IsDir != c.dir || !fi.Modtime.Equal(mod) || !fi.Atime.Equal(mod) {
+			t.Fatal(c.path, "unexpected info:", fi)
+		}
+		if c.dir {
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		if _, err := a.Stream(buf, c.path); err != nil {
+			t.Fatal(c.path, err)
+		}
+		if buf.String() != c.content {
+			t.Fatal(c.path, "content not matched:", buf.String())
+		}
+	}
+
+	var paths []string
+	for _, fi := range a.Entries() {
+		paths = append(paths, fi.Path)
+	}
+	if strings.Join(paths, ",") != ".,a.txt,sub,sub/b.txt" {
+		t.Fatal("unexpected entries:", paths)
+	}
+}
+
+func TestWriterV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, password := range []string{"", "secret"} {
+		path := filepath.Join(dir, "test.arrpkg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mod := time.Date(2106, 2, 8, 0, 0, 0, 123456789, time.UTC)
+		atime, ctime := mod.Add(time.Nanosecond), mod.Add(2*time.Nanosecond)
+
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteDir(&EntryInfo{Path: ".", Mode: uint32(os.ModeDir | 0755), Modtime: mod})
+		if _, err := aw.WriteFile(&EntryInfo{Path: "a.txt", Mode: 0644, Modtime: mod, Atime: atime, Ctime: ctime}, strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteError(&EntryInfo{Path: "bad.txt"})
+		if _, err := aw.WriteFile(&EntryInfo{Path: "b.txt", Mode: 0600}, strings.NewReader("world!")); err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		a, err := OpenArchive(path, password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Version != FormatVersion || a.TotalEntries() != 4 || time.Since(a.Created) > time.Minute {
+			t.Fatal("unexpected archive:", a.Version, a.TotalEntries(), a.Created)
+		}
+
+		fi, ok := a.GetInfo("a.txt")
+		if !ok || !fi.Modtime.Equal(mod) || !fi.Atime.Equal(atime) || !fi.Ctime.Equal(ctime) || fi.Mode != 0644 {
+			t.Fatal("unexpected info:", fi)
+		}
+		if fi, _ := a.GetInfo("."); !fi.IsDir {
+			t.Fatal("expect a directory")
+		}
+		if _, _, ok := a.GetFile("bad.txt"); ok || !a.Contains("bad.txt") {
+			t.Fatal("bad.txt should be an error entry")
+		}
+
+		for path, content := range map[string]string{"a.txt": "hello", "b.txt": "world!"} {
+			buf := &bytes.Buffer{}
+			if _, err := a.Stream(buf, path); err != nil {
+				t.Fatal(path, err)
+			}
+			if buf.String() != content {
+				t.Fatal(path, "content not matched:", buf.String())
+			}
+		}
+		a.Close()
+
+		if password == "" {
+			// the plain index ends with the path refs
+			raw, _ := ioutil.ReadFile(path)
+			end := binary.BigEndian.Uint64(raw[24:32]) + binary.BigEndian.Uint64(raw[32:40])
+			binary.BigEndian.PutUint32(raw[end-4:], 4)
+			ioutil.WriteFile(path, raw, 0644)
+			if _, err := OpenArchive(path, "", false); err != ErrCorruptedIndex {
+				t.Fatal("expect ErrCorruptedIndex, got", err)
+			}
+		}
+	}
+}
+
+func TestEpochTimes(t *testing.T) {
+	f, err := ioutil.TempFile("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	epoch := time.Unix(0, 0)
+	aw, err := NewWriter(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.WriteFile(&EntryInfo{Path: "epoch.txt", Modtime: epoch, Atime: epoch, Ctime: epoch.Add(-1)}, strings.NewReader("1970"))
+	aw.WriteFile(&EntryInfo{Path: "zero.txt"}, strings.NewReader("0001"))
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	a, err := OpenArchive(f.Name(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if fi, _ := a.GetInfo("epoch.txt"); !fi.Modtime.Equal(epoch) || !fi.Atime.Equal(epoch) || !fi.Ctime.Equal(epoch.Add(-1)) {
+		t.Fatal("unexpected times:", fi.Modtime, fi.Atime, fi.Ctime)
+	}
+	if fi, _ := a.GetInfo("zero.txt"); !fi.Modtime.IsZero() || !fi.Atime.IsZero() || !fi.Ctime.IsZero() {
+		t.Fatal("unexpected times:", fi.Modtime, fi.Atime, fi.Ctime)
+	}
+}
+
+// onlyReader hides the io.Seeker of the underlying reader
+type onlyReader struct{ io.Reader }
+
+func TestCodecs(t *testing.T) {
+	f, err := ioutil.TempFile("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	noise := make([]byte, 4096)
+	rand.Read(noise)
+	jpegish := "\xff\xd8\xff" + text
+
+	aw, err := NewWriter(f, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path    string
+		content string
+		r       io.Reader
+		policy  Codec
+		codec   Codec
+	}{
+		{"none.txt", text, nil, CodecNone, CodecNone},
+		{"deflate.txt", text, nil, CodecDeflate, CodecDeflate},
+		{"gzip.txt", text, nil, CodecGzip, CodecGzip},
+		{"lzw.txt", text, nil, CodecLZW, CodecLZW},
+		{"empty.txt", "", nil, CodecDeflate, CodecNone},
+		{"noise.bin", string(noise), nil, CodecDeflate, CodecNone},
+		{"noise.stream", string(noise), onlyReader{bytes.NewReader(noise)}, CodecGzip, CodecGzip},
+		{"photo.jpg", text, nil, CodecDeflate, CodecNone},
+		{"photo.bin", jpegish, nil, CodecDeflate, CodecNone},
+	}
+
+	for _, c := range cases {
+		aw.Policy = DefaultCodecPolicy(c.policy)
+		r := c.r
+		if r == nil {
+			r = strings.NewReader(c.content)
+		}
+		if _, err := aw.WriteFile(&EntryInfo{Path: c.path}, r); err != nil {
+			t.Fatal(c.path, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	a, err := OpenArchive(f.Name(), "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	for _, c := range cases {
+		fi, _ := a.GetInfo(c.path)
+		_, stored, _ := a.GetFile(c.path)
+		if fi.Codec != c.codec || fi.Size != int64(len(c.content)) || fi.Hash != sha256.Sum256([]byte(c.content)) {
+			t.Fatal(c.path, "unexpected info:", fi.Codec, fi.Size)
+		}
+		if c.codec != CodecNone && c.path != "noise.stream" && int(stored) >= len(c.content) {
+			t.Fatal(c.path, "not compressed:", stored)
+		}
+
+		buf := &bytes.Buffer{}
+		if n, err := a.Stream(buf, c.path); err != nil || n != int64(len(c.content)) {
+			t.Fatal(c.path, n, err)
+		}
+		if buf.String() != c.content {
+			t.Fatal(c.path, "content not matched")
+		}
+	}
+
+	// flip a byte in the middle of a compressed entry
+	start, l, _ := a.GetFile("lzw.txt")
+	raw, _ := ioutil.ReadFile(f.Name())
+	raw[start+l/2] ^= 0xff
+	ioutil.WriteFile(f.Name(), raw, 0644)
+
+	b, err := OpenArchive(f.Name(), "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Stream(ioutil.Discard, "lzw.txt"); err == nil {
+		t.Fatal("expect an error")
+	}
+	if _, err := b.Stream(ioutil.Discard, "gzip.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	f, err := ioutil.TempFile("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	text := strings.Repeat("attack at dawn ", 100)
+	large := make([]byte, sealChunk*3+100)
+	rand.Read(large)
+
+	aw, err := NewWriter(f, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"a.txt": text, "b.txt": text, "hidden-name.txt": "", "large.bin": string(large)} {
+		if _, err := aw.WriteFile(&EntryInfo{Path: path}, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	raw, _ := ioutil.ReadFile(f.Name())
+	if bytes.Contains(raw, []byte("hidden-name")) || bytes.Contains(raw, []byte("attack")) {
+		t.Fatal("plaintext found in the archive")
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		if _, err := OpenArchive(f.Name(), password, false); err != ErrWrongPassword {
+			t.Fatalf("%q: expect ErrWrongPassword, got %v", password, err)
+		}
+	}
+
+	a, err := OpenArchive(f.Name(), "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.Flags&FlagEncrypted == 0 {
+		t.Fatal("archive is not encrypted")
+	}
+
+	sa, la, _ := a.GetFile("a.txt")
+	sb, lb, _ := a.GetFile("b.txt")
+	if la != lb || bytes.Equal(raw[sa:sa+la], raw[sb:sb+lb]) {
+		t.Fatal("identical files should have different ciphertexts")
+	}
+
+	for path, content := range map[string]string{"a.txt": text, "hidden-name.txt": "", "large.bin": string(large)} {
+		buf := &bytes.Buffer{}
+		if _, err := a.Stream(buf, path); err != nil {
+			t.Fatal(path, err)
+		}
+		if buf.String() != content {
+			t.Fatal(path, "content not matched")
+		}
+	}
+
+	// tamper the last chunk of large.bin and the index
+	sl, ll, _ := a.GetFile("large.bin")
+	raw[sl+ll-1] ^= 1
+	ioutil.WriteFile(f.Name(), raw, 0644)
+	b, err := OpenArchive(f.Name(), "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stream(ioutil.Discard, "large.bin"); err != ErrCorruptedHash {
+		t.Fatal("expect ErrCorruptedHash, got", err)
+	}
+	b.Close()
+
+	// the index is followed by the trailer
+	end := binary.BigEndian.Uint64(raw[24:32]) + binary.BigEndian.Uint64(raw[32:40])
+	raw[end-1] ^= 1
+	ioutil.WriteFile(f.Name(), raw, 0644)
+	if _, err := OpenArchive(f.Name(), "secret", false); err != ErrCorruptedHash {
+		t.Fatal("expect ErrCorruptedHash, got", err)
+	}
+}
+
+func TestEncryptedHeader(t *testing.T) {
+	f, err := ioutil.TempFile("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	aw, err := NewWriter(f, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	good, _ := ioutil.ReadFile(f.Name())
+
+	for _, c := range []struct {
+		name   string
+		tamper func(p []byte)
+		err    error
+	}{
+		{"none", func(p []byte) {}, nil},
+		{"flags", func(p []byte) { p[11] ^= byte(FlagPathRefs) }, ErrCorruptedHash},
+		{"count", func(p []byte) { p[15]++ }, ErrCorruptedHash},
+		{"created", func(p []byte) { p[23] ^= 1 }, ErrCorruptedHash},
+		{"no iterations", func(p []byte) {
+			binary.BigEndian.PutUint32(p[HeaderV2Size+16:], 0)
+		}, ErrInvalidKeyBlock},
+		{"max iterations", func(p []byte) {
+			binary.BigEndian.PutUint32(p[HeaderV2Size+16:], math.MaxUint32)
+		}, ErrInvalidKeyBlock},
+	} {
+		raw := append([]byte{}, good...)
+		c.tamper(raw)
+		ioutil.WriteFile(f.Name(), raw, 0644)
+		a, err := OpenArchive(f.Name(), "secret", false)
+		if err != c.err {
+			t.Fatalf("%s: expect %v, got %v", c.name, c.err, err)
+		}
+		if err == nil {
+			a.Close()
+		}
+	}
+}
+
+func TestOpenV1Encrypted(t *testing.T) {
+	a, err := OpenArchive("testdata/v1_secret.arrpkg", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	buf := &bytes.Buffer{}
+	if _, err := a.Stream(buf, "sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "world!" {
+		t.Fatal("content not matched:", buf.String())
+	}
+}
+
+func TestPathCollisions(t *testing.T) {
+	// every path falls into one of 3 buckets
+	pathHash = func(s string) uint64 { return uint64(len(s) % 3) }
+	defer func() { pathHash = fnv1a64 }()
+
+	f, err := ioutil.TempFile("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	aw, err := NewWriter(f, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		if i%10 == 0 {
+			if err := aw.WriteDir(&EntryInfo{Path: fmt.Sprintf("dir%d", i)}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		path, content := fmt.Sprintf("dir%d/file%d", i/10*10, i), strings.Repeat("x", i)
+		files[path] = content
+		if _, err := aw.WriteFile(&EntryInfo{Path: path}, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := aw.WriteFile(&EntryInfo{Path: "dir0/file1"}, strings.NewReader("dup")); err != ErrDuplicatePath {
+		t.Fatal("expect duplicate path, got:", err)
+	}
+	if err := aw.WriteDir(&EntryInfo{Path: "dir10"}); err != ErrDuplicatePath {
+		t.Fatal("expect duplicate path, got:", err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if aw.Collisions() != 47 {
+		t.Fatal("unexpected collisions:", aw.Collisions())
+	}
+
+	a, err := OpenArchive(f.Name(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	for path, content := range files {
+		fi, ok := a.GetInfo(path)
+		if !ok || fi.Path != path || fi.Size != int64(len(content)) {
+			t.Fatal(path, "unexpected info:", fi)
+		}
+		if _, size, ok := a.GetFile(path); !ok || size != uint64(len(content)) {
+			t.Fatal(path, "unexpected size:", size)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := a.Stream(buf, path); err != nil {
+			t.Fatal(path, err)
+		}
+		if buf.String() != content {
+			t.Fatal(path, "content not matched:", buf.String())
+		}
+	}
+	if _, _, ok := a.GetFile("dir20"); ok || !a.Contains("dir20") {
+		t.Fatal("dir20 should be a directory")
+	}
+	if a.Contains("dir0/file10") {
+		t.Fatal("dir0/file10 shouldn't exist")
+	}
+
+	seen := 0
+	a.Iterate(func(fi *EntryInfo, start, size uint64) error {
+		if !fi.IsDir {
+			if s, l, _ := a.GetFile(fi.Path); s != start || l != size {
+				t.Fatal(fi.Path, "unexpected position:", start, size)
+			}
+		}
+		seen++
+		return nil
+	})
+	if seen != 50 {
+		t.Fatal("unexpected iterated entries:", seen)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	for _, password := range []string{"", "secret"} {
+		f, err := ioutil.TempFile("", "arp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = func(path string, head []byte) Codec { return Codec(len(path) % 4) }
+		files := map[string][]byte{}
+		for i := 0; i < 64; i++ {
+			path, content := fmt.Sprintf("file%d", i), make([]byte, i*1000)
+			rand.Read(content[:len(content)/2])
+			files[path] = content
+			if _, err := aw.WriteFile(&EntryInfo{Path: path}, bytes.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		a, err := OpenArchive(f.Name(), password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make(chan error, len(files)*2)
+		for path, content := range files {
+			go func(path string, content []byte) {
+				buf := &bytes.Buffer{}
+				if _, err := a.Stream(buf, path); err != nil {
+					errs <- err
+				} else if !bytes.Equal(buf.Bytes(), content) {
+					errs <- fmt.Errorf("%s: content not matched", path)
+				} else {
+					errs <- nil
+				}
+			}(path, content)
+
+			go func(path string, content []byte) {
+				r, err := a.OpenEntry(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer r.Close()
+				half := int64(len(content) / 2)
+				if _, err := r.Seek(half, io.SeekStart); err != nil {
+					errs <- err
+					return
+				}
+				tail, err := ioutil.ReadAll(r)
+				if err != nil {
+					errs <- err
+					return
+				}
+				head := make([]byte, half)
+				if _, err := r.(io.ReaderAt).ReadAt(head, 0); err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(append(head, tail...), content) {
+					errs <- fmt.Errorf("%s: random access not matched", path)
+					return
+				}
+				errs <- nil
+			}(path, content)
+		}
+		for i := 0; i < len(files)*2; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.Close()
+	}
+}
+
+func TestAppendWriter(t *testing.T) {
+	for _, password := range []string{"", "secret"} {
+		f, err := ioutil.TempFile("", "arp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = DefaultCodecPolicy(CodecDeflate)
+		aw.WriteDir(&EntryInfo{Path: "."})
+		aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("hello"))
+		aw.WriteFile(&EntryInfo{Path: "b.txt"}, strings.NewReader("world!"))
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(want map[string]string) {
+			a, err := OpenArchive(f.Name(), password, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			if a.TotalEntries() != len(want)+1 {
+				t.Fatal("unexpected entries:", a.TotalEntries())
+			}
+			for path, content := range want {
+				buf := &bytes.Buffer{}
+				if _, err := a.Stream(buf, path); err != nil {
+					t.Fatal(path, err)
+				}
+				if buf.String() != content {
+					t.Fatal(path, "content not matched:", buf.String())
+				}
+			}
+		}
+
+		// an update which never commits leaves the archive as it was
+		aw, err = NewAppendWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("lost"))
+		check(map[string]string{"a.txt": "hello", "b.txt": "world!"})
+
+		if _, err := NewAppendWriter(f, "wrong"+password); err == nil {
+			t.Fatal("expect an error on the wrong password")
+		}
+
+		aw, err = NewAppendWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi, ok := aw.Lookup("b.txt"); !ok || fi.Size != 6 {
+			t.Fatal("unexpected entry:", fi)
+		}
+		if _, err := aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("hello again")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("twice")); err != ErrDuplicatePath {
+			t.Fatal("expect duplicate path, got:", err)
+		}
+		if _, err := aw.WriteFile(&EntryInfo{Path: "c.txt"}, strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		check(map[string]string{"a.txt": "hello again", "b.txt": "world!", "c.txt": "new"})
+	}
+
+	f, err := os.Open("testdata/v1.arrpkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := NewAppendWriter(f, ""); err != ErrNotAppendable {
+		t.Fatal("expect v1 archives not appendable, got:", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, password := range []string{"", "secret"} {
+		path := filepath.Join(dir, "test.arrpkg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = DefaultCodecPolicy(CodecGzip)
+		aw.WriteDir(&EntryInfo{Path: "."})
+		aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader(strings.Repeat("a", 1000)))
+		aw.WriteFile(&EntryInfo{Path: "b.txt"}, strings.NewReader("secret stuff"))
+		aw.WriteError(&EntryInfo{Path: "bad.txt"})
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		aw, err = NewAppendWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("short"))
+		if !aw.Delete("b.txt") || aw.Delete("nope") {
+			t.Fatal("unexpected deletion")
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		before, _ := ioutil.ReadFile(path)
+		n, err := Compact(path, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _ := ioutil.ReadFile(path)
+		if n <= 0 || int64(len(before)-len(after)) != n {
+			t.Fatal("unexpected reclaimed bytes:", n, len(before), len(after))
+		}
+		if password == "" && bytes.Contains(after, []byte("secret stuff")) {
+			t.Fatal("deleted content is still in the archive")
+		}
+
+		a, err := OpenArchive(path, password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.TotalEntries() != 3 || a.Contains("b.txt") || !a.Contains("bad.txt") {
+			t.Fatal("unexpected entries:", a.TotalEntries())
+		}
+		if buf, err := a.ReadFile("a.txt"); err != nil || string(buf) != "short" {
+			t.Fatal("unexpected content:", string(buf), err)
+		}
+		start, length, _ := a.GetFile("a.txt")
+		a.Close()
+
+		// corrupted entries fail the compaction and the archive is left as is
+		after[start+length-1] ^= 0xff
+		ioutil.WriteFile(path, after, 0644)
+		if _, err := Compact(path, password); err == nil {
+			t.Fatal("expect corrupted entries to be detected")
+		}
+		if now, _ := ioutil.ReadFile(path); !bytes.Equal(now, after) {
+			t.Fatal("archive is modified")
+		}
+		if tmps, _ := filepath.Glob(path + ".*.tmp"); len(tmps) > 0 {
+			t.Fatal("temp files left:", tmps)
+		}
+	}
+
+	// entry headers make the archive grow, nothing is reclaimed
+	path := filepath.Join(dir, "plain.arrpkg")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newWriter(f, time.Now(), FlagCodecs|FlagPathRefs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.WriteFile(&EntryInfo{Path: "a.txt"}, strings.NewReader("hello"))
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, _ := os.Stat(path)
+	if n, err := Compact(path, ""); err != nil || n != 0 {
+		t.Fatal("unexpected reclaimed bytes:", n, err)
+	}
+	if after, _ := os.Stat(path); after.Size() <= before.Size() {
+		t.Fatal("archive should have grown:", before.Size(), after.Size())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	build := func(name, password string, mod time.Time, files map[string]string) *Archive {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = DefaultCodecPolicy(CodecDeflate)
+		aw.WriteDir(&EntryInfo{Path: "."})
+		for path, content := range files {
+			aw.WriteFile(&EntryInfo{Path: path, Modtime: mod}, strings.NewReader(content))
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		a, err := OpenArchive(f.Name(), password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	stored := func(a *Archive, path string) []byte {
+		start, length, _ := a.GetFile(path)
+		p := make([]byte, length)
+		a.Fd.ReadAt(p, int64(start))
+		return p
+	}
+
+	a := build("a.arrpkg", "secret", mod, map[string]string{"x.txt": "old x", "a.txt": strings.Repeat("a", 100)})
+	defer a.Close()
+	b := build("b.arrpkg", "secret", mod.Add(time.Hour), map[string]string{"x.txt": "new x", "b.txt": "b"})
+	defer b.Close()
+	v1, err := OpenArchive("testdata/v1.arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+
+	for _, c := range []struct {
+		policy ConflictPolicy
+		want   map[string]string
+	}{
+		{KeepNewest, map[string]string{"x.txt": "new x", "a.txt": strings.Repeat("a", 100), "b.txt": "b"}},
+		{KeepFirst, map[string]string{"x.txt": "old x", "b.txt": "b"}},
+		{RenameConflict, map[string]string{"x.txt": "old x", "x (2).txt": "new x"}},
+		{FailOnConflict, nil},
+	} {
+		path := filepath.Join(dir, "out.arrpkg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw, err := NewWriterFrom(f, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = DefaultCodecPolicy(CodecDeflate)
+		err = Merge(aw, []MergeSource{{Archive: a}, {Archive: b}, {Archive: v1, Prefix: "old/v1"}}, c.policy)
+		if c.want == nil {
+			if !errors.Is(err, ErrConflict) {
+				t.Fatal("expect a conflict, got:", err)
+			}
+			f.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatal(c.policy, err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		out, err := OpenArchive(path, "secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.want["old/v1/sub/b.txt"] = "world!"
+		for path, content := range c.want {
+			if buf, err := out.ReadFile(path); err != nil || string(buf) != content {
+				t.Fatal(c.policy, path, "content not matched:", string(buf), err)
+			}
+		}
+		if fi, err := out.Stat("old/v1/sub"); err != nil || !fi.IsDir() {
+			t.Fatal(c.policy, "directory not merged:", err)
+		}
+
+		// a shares the keys with the output, b doesn't
+		if !bytes.Equal(stored(out, "a.txt"), stored(a, "a.txt")) {
+			t.Fatal("a.txt is not copied as is")
+		}
+		if bytes.Equal(stored(out, "b.txt"), stored(b, "b.txt")) {
+			t.Fatal("b.txt should be encrypted again")
+		}
+		out.Close()
+	}
+
+	// keys opened separately from the same key block are the same keys
+	a2, err := OpenArchive(a.Path, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a2.Close()
+	f, err := os.Create(filepath.Join(dir, "out2.arrpkg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	aw, err := NewWriterFrom(f, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.Policy = DefaultCodecPolicy(CodecDeflate)
+	if err := Merge(aw, []MergeSource{{Archive: a2}}, KeepFirst); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadFile(f.Name()); !bytes.Contains(raw, stored(a2, "a.txt")) {
+		t.Fatal("a.txt of a reopened archive is not copied as is")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := make([]byte, 200<<10)
+	rand.Read(large)
+	want := map[string]string{
+		"a.txt":     strings.Repeat("a", 1000),
+		"sub/b.txt": "zzzf looks like an entry header, zzzf",
+		"c.bin":     string(large),
+	}
+
+	for _, password := range []string{"", "secret"} {
+		path := filepath.Join(dir, "test.arrpkg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.Policy = DefaultCodecPolicy(CodecGzip)
+		aw.WriteDir(&EntryInfo{Path: "."})
+		aw.WriteDir(&EntryInfo{Path: "sub", Mode: 0700})
+		for _, p := range []string{"a.txt", "sub/b.txt", "c.bin"} {
+			aw.WriteFile(&EntryInfo{Path: p, Mode: 0644}, strings.NewReader(want[p]))
+		}
+		aw.WriteFile(&EntryInfo{Path: "gone.txt"}, strings.NewReader("deleted"))
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if aw, err = NewAppendWriter(f, password); err != nil {
+			t.Fatal(err)
+		}
+		aw.Delete("gone.txt")
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		good, _ := ioutil.ReadFile(path)
+		a, err := OpenArchive(path, password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, lc, _ := a.GetFile("c.bin")
+		a.Close()
+		indexOffset := binary.BigEndian.Uint64(good[24:32])
+
+		// scanned entry headers bring back deleted entries
+		recoverFrom := func(raw []byte, scanned bool, lost ...string) {
+			ioutil.WriteFile(path, raw, 0644)
+			out, err := os.Create(path + ".out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			n, l, err := Recover(out, path, password)
+			if err != nil {
+				t.Fatal(password, err)
+			}
+			total := 3
+			if scanned {
+				total++
+			}
+			if n != total-len(lost) || fmt.Sprint(l) != fmt.Sprint(lost) {
+				t.Fatal(password, "unexpected result:", n, l)
+			}
+
+			x, err := OpenArchive(path+".out", password, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer x.Close()
+			for p, content := range want {
+				buf, err := x.ReadFile(p)
+				if len(lost) > 0 && p == lost[0] {
+					if err == nil {
+						t.Fatal(p, "should be lost")
+					}
+					continue
+				}
+				if err != nil || string(buf) != content {
+					t.Fatal(password, p, "content not matched:", err)
+				}
+			}
+			if x.Contains("gone.txt") != scanned {
+				t.Fatal(password, "unexpected deleted entry")
+			}
+			if fi, err := x.Stat("sub"); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+				t.Fatal(password, "directory not recovered:", fi, err)
+			}
+		}
+
+		// the header and key block are damaged, the trailer is used
+		raw := append([]byte{}, good...)
+		for i := 0; i < HeaderV2Size+keyBlockSize; i++ {
+			raw[i] = 0
+		}
+		ioutil.WriteFile(path, raw, 0644)
+		if _, err := OpenArchive(path, password, false); err == nil {
+			t.Fatal("damaged archive opened")
+		}
+		recoverFrom(raw, false)
+
+		// the header and the index are gone, entry headers are scanned
+		raw = append([]byte{}, good[:indexOffset]...)
+		for i := 0; i < HeaderV2Size; i++ {
+			raw[i] = 0
+		}
+		recoverFrom(raw, true)
+
+		// c.bin is damaged as well
+		raw[sc+lc/2] ^= 1
+		recoverFrom(raw, true, "c.bin")
+
+		// nothing to recover
+		ioutil.WriteFile(path, make([]byte, 1000), 0644)
+		out, _ := os.Create(path + ".out")
+		if _, _, err := Recover(out, path, password); err != ErrUnrecoverable {
+			t.Fatal("expect ErrUnrecoverable, got", err)
+		}
+		out.Close()
+	}
+
+	out, _ := os.Create(filepath.Join(dir, "v1.out"))
+	defer out.Close()
+	if _, _, err := Recover(out, "testdata/v1.arrpkg", ""); err != ErrNotRecoverable {
+		t.Fatal("expect ErrNotRecoverable, got", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, password := range []string{"", "secret"} {
+		path := filepath.Join(dir, "test.arrpkg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw, err := NewWriter(f, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteDir(&EntryInfo{Path: ".", Mode: 0755})
+		aw.WriteFile(&EntryInfo{Path: "a.txt", Mode: 0644}, strings.NewReader("hello"))
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenArchive(path, password, false, pub); err != ErrNotSigned {
+			t.Fatal("expect ErrNotSigned, got", err)
+		}
+
+		if aw, err = NewAppendWriter(f, password); err != nil {
+			t.Fatal(err)
+		}
+		aw.Sign(key)
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		a, err := OpenArchive(path, password, false, other, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a.Signer(), pub) || a.Verify(other) != ErrBadSignature {
+			t.Fatal("unexpected signer")
+		}
+		if buf, err := a.ReadFile("a.txt"); err != nil || string(buf) != "hello" {
+			t.Fatal("content not matched:", string(buf), err)
+		}
+		if err := a.VerifyContents(); err != nil {
+			t.Fatal(err)
+		}
+		start, _, _ := a.GetFile("a.txt")
+		a.Close()
+		if _, err := OpenArchive(path, password, true, pub); err == nil {
+			t.Fatal("archives without metadata can't be verified")
+		}
+
+		// the mode of "." is changed, which doesn't affect any content
+		raw, _ := ioutil.ReadFile(path)
+		if password == "" {
+			meta := binary.BigEndian.Uint64(raw[24:32]) + uint64(binary.BigEndian.Uint32(raw[12:16]))*MetaSize
+			raw[meta+7] ^= 1
+			ioutil.WriteFile(path, raw, 0644)
+			if _, err := OpenArchive(path, password, false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := OpenArchive(path, password, false, pub); err != ErrBadSignature {
+				t.Fatal("expect ErrBadSignature, got", err)
+			}
+			raw[meta+7] ^= 1
+		}
+
+		// so is the header, which is also sealed along with the index of encrypted archives
+		raw[16] ^= 1
+		ioutil.WriteFile(path, raw, 0644)
+		expect := ErrBadSignature
+		if password != "" {
+			expect = ErrCorruptedHash
+		}
+		if _, err := OpenArchive(path, password, false, pub); err != expect {
+			t.Fatal("expect", expect, "got", err)
+		}
+		raw[16] ^= 1
+		ioutil.WriteFile(path, raw, 0644)
+
+		// contents are covered by their hashes, not by the signature itself
+		raw[start] ^= 1
+		ioutil.WriteFile(path, raw, 0644)
+		a, err = OpenArchive(path, password, false, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.VerifyContents(); !errors.Is(err, ErrCorruptedHash) {
+			t.Fatal("expect ErrCorruptedHash, got", err)
+		}
+		if _, err := a.OpenEntry("a.txt"); !errors.Is(err, ErrCorruptedHash) {
+			t.Fatal("expect ErrCorruptedHash, got", err)
+		}
+		a.Close()
+		raw[start] ^= 1
+		ioutil.WriteFile(path, raw, 0644)
+
+		// updates drop the signature
+		f, _ = os.OpenFile(path, os.O_RDWR, 0)
+		if aw, err = NewAppendWriter(f, password); err != nil {
+			t.Fatal(err)
+		}
+		aw.WriteFile(&EntryInfo{Path: "b.txt"}, strings.NewReader("world"))
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if _, err := OpenArchive(path, password, false, pub); err != ErrNotSigned {
+			t.Fatal("expect ErrNotSigned, got", err)
+		}
+	}
+}
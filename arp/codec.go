@@ -0,0 +1,129 @@
+package arp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Codec is the compression method of an entry
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecDeflate
+	CodecGzip
+	CodecLZW
+)
+
+var codecNames = [...]string{"none", "deflate", "gzip", "lzw"}
+
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+	return fmt.Sprintf("codec(%d)", c)
+}
+
+// ParseCodec returns the codec of the given name
+func ParseCodec(name string) (Codec, error) {
+	for i, n := range codecNames {
+		if strings.EqualFold(n, name) {
+			return Codec(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec: %s", name)
+}
+
+// CodecPolicy chooses the codec of a file by its path and the leading bytes of its content
+type CodecPolicy func(path string, head []byte) Codec
+
+// the formats which are compressed already
+var compressedExts = map[string]bool{
+	".webp": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".zip": true, ".gz": true, ".bz2": true, ".xz": true, ".7z": true, ".zst": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".webm": true, ".arrpkg": true,
+}
+
+var compressedMagics = []string{
+	"\xff\xd8\xff",      // jpeg
+	"\x89PNG\r\n\x1a\n", // png
+	"PK\x03\x04",        // zip
+	"\x1f\x8b",          // gzip
+	"GIF8",              // gif
+}
+
+// IsCompressed tells whether the file is in a compressed format by its extension or magic
+func IsCompressed(path string, head []byte) bool {
+	if compressedExts[strings.ToLower(filepath.Ext(path))] {
+		return true
+	}
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP" {
+		return true
+	}
+	for _, m := range compressedMagics {
+		if bytes.HasPrefix(head, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCodecPolicy compresses files with codec, except those already compressed
+func DefaultCodecPolicy(codec Codec) CodecPolicy {
+	return func(path string, head []byte) Codec {
+		if IsCompressed(path, head) {
+			return CodecNone
+		}
+		return codec
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func compressor(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	case CodecDeflate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecLZW:
+		return lzw.NewWriter(w, lzw.LSB, 8), nil
+	}
+	return nil, fmt.Errorf("unknown codec: %d", codec)
+}
+
+func decompressor(codec Codec, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return ioutil.NopCloser(r), nil
+	case CodecDeflate:
+		return flate.NewReader(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecLZW:
+		return lzw.NewReader(r, lzw.LSB, 8), nil
+	}
+	return nil, fmt.Errorf("unknown codec: %d", codec)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,131 @@
+package arp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Compact rewrites the archive at path with only the live entries, dropping the contents left
+// behind by updates and deletions. Entries are copied as stored into a temp file next to
+// the archive and verified against their hashes on the way, then the temp file is renamed
+// over the archive. It returns the number of bytes reclaimed, which is 0 if the archive
+// doesn't shrink, e.g. when entry headers are added to archives written without them
+func Compact(path, password string) (int64, error) {
+	a, err := OpenArchive(path, password, false)
+	if err != nil {
+		return 0, err
+	}
+	if a.Version != FormatVersion || a.Flags&FlagCodecs == 0 || (password != "" && a.keys == nil) {
+		a.Close()
+		return 0, ErrNotAppendable
+	}
+
+	// the archive must be closed before it's replaced
+	tmp, size, err := a.compactTo(path)
+	a.Close()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if a.Size < size {
+		return 0, nil
+	}
+	return a.Size - size, nil
+}
+
+// compactTo writes the live entries of a into a temp file next to path, and returns
+// the name and size of it, the file is removed if anything fails
+func (a *Archive) compactTo(path string) (name string, size int64, err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// the key block is kept, so are the keys of the stored contents
+	block, err := a.keyBlock()
+	if err != nil {
+		return "", 0, err
+	}
+	aw, err := newWriter(tmp, a.Created, a.Flags|FlagPathRefs|FlagRecovery, block, a.keys)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, fi := range a.entries {
+		start, length, _ := a.Cursor.Get(fi.Path)
+		switch start {
+		case DirFlag:
+			err = aw.WriteDir(fi)
+		case ErrFlag:
+			err = aw.WriteError(fi)
+		default:
+			err = aw.copyStored(a, fi, fi, start, length, true)
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("%s: %v", fi.Path, err)
+		}
+	}
+
+	if err = aw.Close(); err != nil {
+		return "", 0, err
+	}
+	if err = tmp.Chmod(a.Info.Mode()); err != nil {
+		return "", 0, err
+	}
+	st, err := tmp.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	return tmp.Name(), st.Size(), tmp.Close()
+}
+
+// keyBlock reads the key block of encrypted archives, nil for others
+func (a *Archive) keyBlock() ([]byte, error) {
+	if a.keys == nil {
+		return nil, nil
+	}
+	block := make([]byte, keyBlockSize)
+	if _, err := a.Fd.ReadAt(block, HeaderV2Size); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// copyStored copies the stored bytes of src in a as is and adds them as dst, if verify is set,
+// they are decoded on the fly to verify the hash
+func (aw *Writer) copyStored(a *Archive, src, dst *EntryInfo, start, length uint64, verify bool) error {
+	frame := aw.cursor
+	if _, err := aw.w.Seek(frame+aw.frameSize(dst.Path), 0); err != nil {
+		return err
+	}
+	stored := io.TeeReader(io.NewSectionReader(a.Fd, int64(start), int64(length)), aw.w)
+	if verify {
+		if _, err := a.streamDecoded(ioutil.Discard, src, stored, int64(length)); err != nil {
+			return err
+		}
+	}
+	// copy the rest, decompressors may stop before the end of the stored bytes
+	if _, err := io.Copy(ioutil.Discard, stored); err != nil {
+		return err
+	}
+	if err := aw.writeFrame(frame, dst, int64(length)); err != nil {
+		return err
+	}
+
+	aw.cursor += aw.frameSize(dst.Path)
+	aw.push(dst, uint64(aw.cursor), length)
+	aw.cursor += int64(length)
+	return nil
+}
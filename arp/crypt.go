@@ -0,0 +1,271 @@
+package arp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrWrongPassword indicates the password doesn't match the key check value of the archive
+var ErrWrongPassword = errors.New("wrong password")
+
+// ErrInvalidKeyBlock indicates the key derivation parameters of the archive are out of range
+var ErrInvalidKeyBlock = errors.New("invalid key block")
+
+// Encrypted archives (FlagEncrypted) have a key block right after the header:
+// (16b) salt, (4b) PBKDF2 iterations, (32b) key check value.
+// Every entry is sealed by AES-GCM in chunks of sealChunk bytes:
+// (16b) random salt, chunk1 + tag, chunk2 + tag, ...
+// where the key of the entry is HKDF-SHA256 of the data key and the salt, and the nonce of
+// a chunk is (7b) zeros + (4b) counter + (1b) 1 for the last chunk, 0 otherwise, so reordered,
+// truncated or extended chunks are all rejected. Keys are never shared by entries, so nonces
+// only have to be unique within an entry.
+// The jmptable and metadata are sealed as a whole: (12b) random nonce, index + tag,
+// with the header as the additional data, see indexAD
+const (
+	keyBlockSize = 16 + 4 + sha256.Size
+	sealChunk    = 64 << 10
+	entrySalt    = 16
+
+	minKDFIterations = 1000
+	maxKDFIterations = 10000000
+)
+
+var kdfIterations = 100000
+
+type archiveKeys struct {
+	data  []byte // the data key, entry keys are derived from it
+	meta  cipher.AEAD
+	check []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+func deriveKeys(password string, salt []byte, iter int) (*archiveKeys, error) {
+	master := pbkdf2([]byte(password), salt, iter, 32)
+	sub := func(label string) []byte {
+		m := hmac.New(sha256.New, master)
+		m.Write([]byte(label))
+		return m.Sum(nil)
+	}
+
+	k := &archiveKeys{check: sub("arp key check"), data: sub("arp data")}
+	var err error
+	if k.meta, err = newAEAD(sub("arp metadata")); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// same reports whether k and o are derived from the same password and salt, so the contents
+// sealed by one can be opened by the other
+func (k *archiveKeys) same(o *archiveKeys) bool {
+	if k == nil || o == nil {
+		return k == o
+	}
+	return hmac.Equal(k.check, o.check)
+}
+
+// entryAEAD derives the key of the entry with the given salt, by HKDF-SHA256 (RFC 5869)
+// with a single block of output
+func (k *archiveKeys) entryAEAD(salt []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, salt)
+	m.Write(k.data)
+	m = hmac.New(sha256.New, m.Sum(nil))
+	m.Write([]byte("arp entry"))
+	m.Write([]byte{1})
+	return newAEAD(m.Sum(nil))
+}
+
+// newKeyBlock generates a random salt and derives the keys
+func newKeyBlock(password string) ([]byte, *archiveKeys, error) {
+	p := make([]byte, keyBlockSize)
+	if _, err := rand.Read(p[:16]); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint32(p[16:20], uint32(kdfIterations))
+
+	k, err := deriveKeys(password, p[:16], kdfIterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(p[20:], k.check)
+	return p, k, nil
+}
+
+// openKeyBlock derives the keys and checks them against the key block
+func openKeyBlock(p []byte, password string) (*archiveKeys, error) {
+	if password == "" {
+		return nil, ErrWrongPassword
+	}
+	// a forged count could make opening the archive take forever, or the key trivial
+	iter := binary.BigEndian.Uint32(p[16:20])
+	if iter < minKDFIterations || iter > maxKDFIterations {
+		return nil, ErrInvalidKeyBlock
+	}
+	k, err := deriveKeys(password, p[:16], int(iter))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(k.check, p[20:keyBlockSize]) {
+		return nil, ErrWrongPassword
+	}
+	return k, nil
+}
+
+func chunkNonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint32
+}
+
+func newSealWriter(w io.Writer, keys *archiveKeys) (*sealWriter, error) {
+	salt := make([]byte, entrySalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keys.entryAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead}, nil
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	// keep at least one byte, the last chunk is sealed by Close
+	for len(sw.buf) > sealChunk {
+		if err := sw.seal(sw.buf[:sealChunk], false); err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[sealChunk:]...)
+	}
+	return len(p), nil
+}
+
+func (sw *sealWriter) seal(p []byte, last bool) error {
+	out := sw.aead.Seal(nil, chunkNonce(sw.counter, last), p, nil)
+	sw.counter++
+	_, err := sw.w.Write(out)
+	return err
+}
+
+func (sw *sealWriter) Close() error {
+	return sw.seal(sw.buf, true)
+}
+
+type openReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	remain  int64
+	chunk   []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// newOpenReader reads a sealed entry of length bytes from r
+func newOpenReader(r io.Reader, keys *archiveKeys, length int64) (*openReader, error) {
+	salt := make([]byte, entrySalt)
+	if length-entrySalt < int64(keys.meta.Overhead()) {
+		return nil, ErrCorruptedHash
+	}
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+	aead, err := keys.entryAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: r, aead: aead, remain: length - entrySalt}, nil
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.plain) == 0 {
+		if or.done {
+			return 0, io.EOF
+		}
+
+		n := int64(sealChunk + or.aead.Overhead())
+		last := or.remain <= n
+		if last {
+			n = or.remain
+		}
+		if cap(or.chunk) < int(n) {
+			or.chunk = make([]byte, n)
+		}
+		chunk := or.chunk[:n]
+		if _, err := io.ReadFull(or.r, chunk); err != nil {
+			return 0, err
+		}
+		or.remain -= n
+
+		plain, err := or.aead.Open(chunk[:0], chunkNonce(or.counter, last), chunk, nil)
+		if err != nil {
+			return 0, ErrCorruptedHash
+		}
+		or.counter++
+		or.plain, or.done = plain, last
+	}
+
+	n := copy(p, or.plain)
+	or.plain = or.plain[n:]
+	return n, nil
+}
+
+// sealedSize returns the size of n bytes sealed by sealIndex
+func sealedSize(aead cipher.AEAD, n int) int {
+	return aead.NonceSize() + n + aead.Overhead()
+}
+
+// indexAD returns the additional data of the sealed index, which is the header without
+// the offsets, as they differ between the header and the copy in the trailer
+func indexAD(h headerV2) []byte {
+	h.indexOffset, h.sigOffset = 0, 0
+	return h.marshal()
+}
+
+// sealIndex seals the jmptable and metadata, or an entry record, along with ad
+func sealIndex(aead cipher.AEAD, index, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, index, ad), nil
+}
+
+func openIndex(aead cipher.AEAD, p, ad []byte) ([]byte, error) {
+	ns := aead.NonceSize()
+	if len(p) < ns {
+		return nil, ErrCorruptedHash
+	}
+	index, err := aead.Open(nil, p[:ns], p[ns:], ad)
+	if err != nil {
+		return nil, ErrCorruptedHash
+	}
+	return index, nil
+}
@@ -0,0 +1,167 @@
+package arp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+	"unsafe"
+)
+
+// Format v2:
+// +------------+-------------+-------+-------+-- - --+----------+----------+
+// | 64b header | [key block] | file1 | file2 |  ...  | jmptable | metadata |
+// +------------+-------------+-------+-------+-- - --+----------+----------+
+// Header fields, all in big endian:
+// 00 (4b) Magic code: zzzz
+// 04 (2b) Format version: 2
+// 06 (1b) Endianness of jmptable, the first byte of uint64(1) in memory
+// 07 (1b) Reserved
+// 08 (4b) Flags of optional features
+// 12 (4b) Total entries
+// 16 (8b) Archive created time, unix nanoseconds as all times are, the zero time is MinInt64
+// 24 (8b) Offset of jmptable, metadata follows it directly
+// 32 (8b) Size of jmptable and metadata
+// 40 (8b) Offset of the signature block if FlagSigned, see sign.go
+// 48 (16b) Reserved, must be zeros
+// Metadata of every entry, in the order of archiving:
+// (2b) path length, (2b) entry flags, (4b) mode, (8b) modtime, (8b) atime, (8b) ctime,
+// (32b) sha256 (DirGUID for directories), [(1b) codec, (8b) original size if FlagCodecs], path
+// With FlagPathRefs, the metadata is followed by (4b) the metadata position of every jmptable row.
+// With FlagRecovery, every stored file and directory is preceded by an entry header, and the
+// index is followed by a trailer, see recover.go
+const (
+	HeaderV2      = "zzzz"
+	HeaderV2Size  = 64
+	FormatVersion = 2
+
+	entryHdrV2    = 2 + 2 + 4 + 8 + 8 + 8 + sha256.Size
+	entryCodecExt = 1 + 8
+)
+
+// Flags of optional features in the v2 header
+const (
+	// FlagCodecs: entries may be compressed, and the hash is computed over the original content
+	// instead of the stored bytes
+	FlagCodecs uint32 = 1 << iota
+	// FlagEncrypted: entries and the index are sealed by AES-GCM, see crypt.go
+	FlagEncrypted
+	// FlagPathRefs: paths are hashed by fnv1a64, and the metadata is followed by (4b) the
+	// metadata position of every jmptable row, so lookups can verify the full path
+	FlagPathRefs
+	// FlagRecovery: entries have headers next to their contents and the index has a copy at
+	// the end of the file, so damaged archives can be recovered. Entries written by older
+	// versions before an update have no headers
+	FlagRecovery
+	// FlagSigned: the root hash of the archive is signed by ed25519, see sign.go
+	FlagSigned
+)
+
+type headerV2 struct {
+	version     uint16
+	flags       uint32
+	count       uint32
+	created     int64
+	indexOffset uint64
+	indexSize   uint64
+	sigOffset   uint64
+	signature   []byte // the signature block, read by readIndexV2
+}
+
+func (h *headerV2) marshal() []byte {
+	p := make([]byte, HeaderV2Size)
+	copy(p, HeaderV2)
+	binary.BigEndian.PutUint16(p[4:6], h.version)
+	p[6] = *(*byte)(unsafe.Pointer(&One))
+	binary.BigEndian.PutUint32(p[8:12], h.flags)
+	binary.BigEndian.PutUint32(p[12:16], h.count)
+	binary.BigEndian.PutUint64(p[16:24], uint64(h.created))
+	binary.BigEndian.PutUint64(p[24:32], h.indexOffset)
+	binary.BigEndian.PutUint64(p[32:40], h.indexSize)
+	binary.BigEndian.PutUint64(p[40:48], h.sigOffset)
+	return p
+}
+
+func (h *headerV2) unmarshal(p []byte) error {
+	if len(p) < HeaderV2Size || string(p[:4]) != HeaderV2 {
+		return ErrInvalidHeader
+	}
+	h.version = binary.BigEndian.Uint16(p[4:6])
+	if h.version != FormatVersion {
+		return ErrUnsupportedVersion
+	}
+	if p[6] != *(*byte)(unsafe.Pointer(&One)) {
+		return ErrEndianness
+	}
+	h.flags = binary.BigEndian.Uint32(p[8:12])
+	h.count = binary.BigEndian.Uint32(p[12:16])
+	h.created = int64(binary.BigEndian.Uint64(p[16:24]))
+	h.indexOffset = binary.BigEndian.Uint64(p[24:32])
+	h.indexSize = binary.BigEndian.Uint64(p[32:40])
+	h.sigOffset = binary.BigEndian.Uint64(p[40:48])
+	return nil
+}
+
+// zeroTime is how the zero time.Time is stored, 0 is a valid time (the unix epoch)
+const zeroTime = math.MinInt64
+
+// unixNano converts t into unix nanoseconds, zero time is stored as zeroTime
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return zeroTime
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == zeroTime {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// appendEntryV2 appends the metadata of fi to buf, path is the (encrypted) path
+func appendEntryV2(buf []byte, fi *EntryInfo, path []byte, flags uint32) []byte {
+	p := [entryHdrV2 + entryCodecExt]byte{}
+	binary.BigEndian.PutUint16(p[0:2], uint16(len(path)))
+	binary.BigEndian.PutUint32(p[4:8], fi.Mode)
+	binary.BigEndian.PutUint64(p[8:16], uint64(unixNano(fi.Modtime)))
+	binary.BigEndian.PutUint64(p[16:24], uint64(unixNano(fi.Atime)))
+	binary.BigEndian.PutUint64(p[24:32], uint64(unixNano(fi.Ctime)))
+	copy(p[32:], fi.Hash[:])
+	if flags&FlagCodecs == 0 {
+		buf = append(buf, p[:entryHdrV2]...)
+	} else {
+		p[entryHdrV2] = byte(fi.Codec)
+		binary.BigEndian.PutUint64(p[entryHdrV2+1:], uint64(fi.Size))
+		buf = append(buf, p[:]...)
+	}
+	return append(buf, path...)
+}
+
+// readEntryV2 reads the metadata of an entry, the returned path is still encrypted
+func readEntryV2(r io.Reader, fi *EntryInfo, flags uint32) ([]byte, error) {
+	p := [entryHdrV2 + entryCodecExt]byte{}
+	n := entryHdrV2
+	if flags&FlagCodecs != 0 {
+		n += entryCodecExt
+	}
+	if _, err := io.ReadFull(r, p[:n]); err != nil {
+		return nil, err
+	}
+	fi.Mode = binary.BigEndian.Uint32(p[4:8])
+	fi.Modtime = fromUnixNano(int64(binary.BigEndian.Uint64(p[8:16])))
+	fi.Atime = fromUnixNano(int64(binary.BigEndian.Uint64(p[16:24])))
+	fi.Ctime = fromUnixNano(int64(binary.BigEndian.Uint64(p[24:32])))
+	copy(fi.Hash[:], p[32:])
+	fi.IsDir = string(fi.Hash[:]) == DirGUID
+	if flags&FlagCodecs != 0 {
+		fi.Codec = Codec(p[entryHdrV2])
+		fi.Size = int64(binary.BigEndian.Uint64(p[entryHdrV2+1:]))
+	}
+
+	path := make([]byte, binary.BigEndian.Uint16(p[0:2]))
+	_, err := io.ReadFull(r, path)
+	return path, err
+}
@@ -0,0 +1,303 @@
+package arp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive implements these so it can be used by http.FS, template.ParseFS, fs.WalkDir, etc.
+var (
+	_ fs.FS         = (*Archive)(nil)
+	_ fs.StatFS     = (*Archive)(nil)
+	_ fs.ReadDirFS  = (*Archive)(nil)
+	_ fs.ReadFileFS = (*Archive)(nil)
+	_ fs.GlobFS     = (*Archive)(nil)
+)
+
+var errIsDir = errors.New("is a directory")
+
+// fsNode is an entry in the directory tree, directories which aren't archived
+// are made up from the paths of their children
+type fsNode struct {
+	info     *EntryInfo
+	children []*fsNode // sorted by name
+	linked   bool      // added to the children of its parent
+}
+
+// buildTree builds the directory tree for io/fs, errored entries and paths
+// which aren't valid in io/fs are left out
+func (x *Archive) buildTree() {
+	x.tree = map[string]*fsNode{}
+	node := func(p string) *fsNode {
+		n := x.tree[p]
+		if n == nil {
+			n = &fsNode{info: &EntryInfo{Path: p, Mode: uint32(fs.ModeDir | 0755), IsDir: true, Modtime: x.Created}}
+			x.tree[p] = n
+		}
+		return n
+	}
+	node(".")
+
+	for _, fi := range x.entries {
+		if !fs.ValidPath(fi.Path) {
+			continue
+		}
+		if start, _, ok := x.Cursor.Get(fi.Path); !ok || start == ErrFlag {
+			continue
+		}
+		node(fi.Path).info = fi
+
+		// link the path and its parents, up to the root
+		for p := fi.Path; p != "."; p = path.Dir(p) {
+			child := x.tree[p]
+			if child.linked {
+				break
+			}
+			parent := node(path.Dir(p))
+			parent.children = append(parent.children, child)
+			child.linked = true
+		}
+	}
+
+	for _, n := range x.tree {
+		sort.Slice(n.children, func(i, j int) bool {
+			return n.children[i].info.Path < n.children[j].info.Path
+		})
+	}
+}
+
+func (x *Archive) lookup(op, name string) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := x.tree[name]
+	if n == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+// Open opens the named file or directory, see OpenEntry for how files are read
+func (a *Archive) Open(name string) (fs.File, error) {
+	n, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.info.IsDir {
+		return &dirFile{node: n}, nil
+	}
+	return a.openFile(n.info)
+}
+
+// OpenEntry opens the file at path for random access, the returned reader also implements
+// io.ReaderAt. Files which are neither compressed nor encrypted are read directly from
+// the archive, others are decoded into memory first. Either way the hash is verified when
+// opening, except for files read directly from unsigned archives. Readers are independent of
+// each other, so it's safe to open and read from many goroutines at once
+func (a *Archive) OpenEntry(path string) (io.ReadSeekCloser, error) {
+	n, err := a.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if n.info.IsDir {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: errIsDir}
+	}
+	return a.openFile(n.info)
+}
+
+func (a *Archive) openFile(fi *EntryInfo) (*file, error) {
+	name := fi.Path
+	f := &file{info: fileInfo{fi}}
+	if a.storedAsIs(fi) {
+		start, length, _ := a.Cursor.Get(name)
+		sr := io.NewSectionReader(a.Fd, int64(start), int64(length))
+		// the signature covers the hash rather than the content, which is checked here
+		if a.Flags&FlagSigned != 0 {
+			n, h, err := HashCopy(ioutil.Discard, sr)
+			if err == nil && (n != fi.Size || !bytes.Equal(h, fi.Hash[:])) {
+				err = ErrCorruptedHash
+			}
+			if err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+			sr.Seek(0, 0)
+		}
+		f.r = sr
+		return f, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, fi.Size))
+	if _, err := a.Stream(buf, name); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f.r = bytes.NewReader(buf.Bytes())
+	return f, nil
+}
+
+// storedAsIs tells whether the stored bytes of fi are its content
+func (a *Archive) storedAsIs(fi *EntryInfo) bool {
+	return a.Password == "" && a.keys == nil && fi.Codec == CodecNone
+}
+
+// Stat returns the info of the named file or directory, Sys() of it returns the *EntryInfo
+func (a *Archive) Stat(name string) (fs.FileInfo, error) {
+	n, err := a.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{n.info}, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name
+func (a *Archive) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.info.IsDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return dirEntries(n.children), nil
+}
+
+// ReadFile returns the content of the named file, the hash is verified
+func (a *Archive) ReadFile(name string) ([]byte, error) {
+	n, err := a.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.info.IsDir {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errIsDir}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, n.info.Size))
+	if _, err := a.Stream(buf, name); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
+}
+
+// Glob returns the names of all files and directories matching pattern, in the order of fs.Glob
+func (a *Archive) Glob(pattern string) ([]string, error) {
+	elems := strings.Split(pattern, "/")
+	for _, e := range elems {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, err
+		}
+	}
+	if pattern == "." {
+		return []string{"."}, nil
+	}
+
+	root := a.tree["."]
+	if root == nil {
+		// opened with jmpTableOnly
+		return nil, nil
+	}
+
+	var names []string
+	var walk func(n *fsNode, depth int)
+	walk = func(n *fsNode, depth int) {
+		for _, c := range n.children {
+			if ok, _ := path.Match(elems[depth], path.Base(c.info.Path)); !ok {
+				continue
+			}
+			if depth == len(elems)-1 {
+				names = append(names, c.info.Path)
+			} else if c.info.IsDir {
+				walk(c, depth+1)
+			}
+		}
+	}
+	walk(root, 0)
+	return names, nil
+}
+
+func dirEntries(nodes []*fsNode) []fs.DirEntry {
+	list := make([]fs.DirEntry, len(nodes))
+	for i, n := range nodes {
+		list[i] = fs.FileInfoToDirEntry(fileInfo{n.info})
+	}
+	return list
+}
+
+// fileInfo implements fs.FileInfo over EntryInfo
+type fileInfo struct{ e *EntryInfo }
+
+func (fi fileInfo) Name() string { return path.Base(fi.e.Path) }
+
+func (fi fileInfo) Size() int64 {
+	if fi.e.IsDir {
+		return 0
+	}
+	return fi.e.Size
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.e.IsDir {
+		return fs.FileMode(fi.e.Mode) | fs.ModeDir
+	}
+	return fs.FileMode(fi.e.Mode)
+}
+
+func (fi fileInfo) ModTime() time.Time { return fi.e.Modtime }
+
+func (fi fileInfo) IsDir() bool { return fi.e.IsDir }
+
+func (fi fileInfo) Sys() interface{} { return fi.e }
+
+type readSeekerAt interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// file is an opened file of the archive, it implements io.ReaderAt and io.Seeker
+type file struct {
+	info fileInfo
+	r    readSeekerAt
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *file) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+
+func (f *file) Seek(offset int64, whence int) (int64, error) { return f.r.Seek(offset, whence) }
+
+func (f *file) Close() error { return nil }
+
+// dirFile is an opened directory of the archive, it implements fs.ReadDirFile
+type dirFile struct {
+	node   *fsNode
+	offset int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return fileInfo{d.node.info}, nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.info.Path, Err: errIsDir}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.node.children[d.offset:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	d.offset += len(rest)
+	return dirEntries(rest), nil
+}
+
+func (d *dirFile) Close() error { return nil }
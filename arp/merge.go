@@ -0,0 +1,206 @@
+package arp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrConflict indicates archives being merged have different entries at the same path
+var ErrConflict = errors.New("conflicting entries")
+
+// ConflictPolicy decides which entry to keep when merged archives have the same path,
+// directories are always merged
+type ConflictPolicy byte
+
+const (
+	// KeepNewest keeps the entry with the latest modtime, or the first one if they are equal
+	KeepNewest ConflictPolicy = iota
+	// KeepFirst keeps the entry of the first archive
+	KeepFirst
+	// FailOnConflict stops merging with ErrConflict
+	FailOnConflict
+	// RenameConflict keeps all of them, later ones are renamed to "name (2).ext" and so on
+	RenameConflict
+)
+
+var policyNames = [...]string{"newest", "first", "fail", "rename"}
+
+func (p ConflictPolicy) String() string {
+	if int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return fmt.Sprintf("policy(%d)", p)
+}
+
+// ParseConflictPolicy returns the policy of the given name
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for i, n := range policyNames {
+		if strings.EqualFold(n, name) {
+			return ConflictPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy: %s", name)
+}
+
+// MergeSource is an archive to be merged, its entries are put under Prefix
+type MergeSource struct {
+	Archive *Archive
+	Prefix  string
+}
+
+type mergeItem struct {
+	src  int
+	fi   *EntryInfo
+	path string
+}
+
+// NewWriterFrom starts a new archive in w with the password and the key block of a,
+// so the stored contents of a can be copied without decrypting them
+func NewWriterFrom(w io.WriteSeeker, a *Archive) (*Writer, error) {
+	if a.keys == nil {
+		return NewWriter(w, a.Password)
+	}
+	block, err := a.keyBlock()
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(w, time.Now(), FlagCodecs|FlagPathRefs|FlagRecovery|FlagEncrypted, block, a.keys)
+}
+
+// Merge writes the entries of all sources into aw in order, aw isn't closed.
+// Stored contents are copied byte for byte if aw has the keys of the source, i.e. the same password
+// and key block (see NewWriterFrom), which holds for archives compacted from or appended to each other
+// and its Policy chooses the same codec by the path, otherwise they are decoded and encoded again.
+// Transcode manifests are merged as well
+func Merge(aw *Writer, sources []MergeSource, policy ConflictPolicy) error {
+	taken := map[string]bool{}
+	for _, src := range sources {
+		for _, fi := range src.Archive.Entries() {
+			taken[path.Join(src.Prefix, fi.Path)] = true
+		}
+	}
+
+	plan := map[string]*mergeItem{}
+	var items []*mergeItem
+	for s, src := range sources {
+		for _, fi := range src.Archive.Entries() {
+			if fi.Path == TranscodeManifest {
+				continue
+			}
+			item := &mergeItem{src: s, fi: fi, path: path.Join(src.Prefix, fi.Path)}
+			old := plan[item.path]
+			if old == nil {
+				plan[item.path] = item
+				items = append(items, item)
+				continue
+			}
+			if old.fi.IsDir && fi.IsDir {
+				continue
+			}
+
+			switch policy {
+			case KeepNewest:
+				if fi.Modtime.After(old.fi.Modtime) {
+					old.src, old.fi = s, fi
+				}
+			case FailOnConflict:
+				return &fs.PathError{Op: "merge", Path: item.path, Err: ErrConflict}
+			case RenameConflict:
+				item.path = renamePath(item.path, taken)
+				taken[item.path] = true
+				plan[item.path] = item
+				items = append(items, item)
+			}
+		}
+	}
+
+	manifest := map[string]*TranscodeInfo{}
+	infos := make([]map[string]*TranscodeInfo, len(sources))
+	for s, src := range sources {
+		var err error
+		if infos[s], err = src.Archive.TranscodeInfos(); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		if err := aw.copyEntry(sources[item.src].Archive, item.fi, item.path); err != nil {
+			return &fs.PathError{Op: "merge", Path: item.path, Err: err}
+		}
+		if t := infos[item.src][item.fi.Path]; t != nil {
+			manifest[item.path] = t
+		}
+	}
+
+	if len(manifest) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = aw.WriteFile(&EntryInfo{Path: TranscodeManifest, Mode: 0644, Modtime: now, Atime: now, Ctime: now}, bytes.NewReader(buf))
+	return err
+}
+
+// renamePath returns "name (n).ext" with the smallest n >= 2 not taken
+func renamePath(p string, taken map[string]bool) string {
+	ext := path.Ext(p)
+	if ext == path.Base(p) {
+		// dot files like .profile have no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(p, ext)
+	for n := 2; ; n++ {
+		if np := fmt.Sprintf("%s (%d)%s", base, n, ext); !taken[np] {
+			return np
+		}
+	}
+}
+
+// copyEntry adds fi of a as p, see Merge
+func (aw *Writer) copyEntry(a *Archive, fi *EntryInfo, p string) error {
+	start, length, _ := a.Cursor.Get(fi.Path)
+	dst := *fi
+	dst.Path = p
+
+	switch start {
+	case DirFlag:
+		return aw.WriteDir(&dst)
+	case ErrFlag:
+		return aw.WriteError(&dst)
+	}
+
+	if err := aw.checkPath(p); err != nil {
+		return err
+	}
+	codec := CodecNone
+	if aw.Policy != nil {
+		codec = aw.Policy(p, nil)
+	}
+	if a.Flags&FlagCodecs != 0 && a.keys.same(aw.keys) && (a.keys != nil || a.Password == "") && codec == fi.Codec {
+		return aw.copyStored(a, fi, &dst, start, length, false)
+	}
+
+	r, err := a.openFile(fi)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := aw.WriteFile(&dst, r); err != nil {
+		return err
+	}
+	// the hash of v1 encrypted archives covers the stored bytes, they are verified by openFile
+	if (a.Flags&FlagCodecs != 0 || a.Password == "") && dst.Hash != fi.Hash {
+		return ErrCorruptedHash
+	}
+	return nil
+}
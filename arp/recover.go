@@ -0,0 +1,294 @@
+package arp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Recovery records of FlagRecovery archives:
+// Entry header, right before the stored bytes of every file, and for every directory:
+// (4b) magic: zzzf, (4b) record size, (8b) stored size, record
+// where the record is the metadata of the entry as in the index, with the codec and the original
+// size, and sealed along with the path by AES-GCM in encrypted archives.
+// Trailer, right after the index and the signature block, if any:
+// +---------------+-------------+-------------+
+// | index (copy)  | 64b header  | [key block] |
+// +---------------+-------------+-------------+
+// The header is the same as the first one except it points to the copy of the index,
+// so the archive can still be opened from it if the beginning of the file is damaged
+const (
+	frameMagic   = "zzzf"
+	frameHdrSize = 4 + 4 + 8
+	frameMaxRec  = entryHdrV2 + entryCodecExt + 65535 + 64
+)
+
+// ErrUnrecoverable indicates nothing of the archive can be read, not even the key block
+var ErrUnrecoverable = errors.New("archive can't be recovered")
+
+// ErrNotRecoverable indicates the archive has no entry frames, i.e. v1 archives and v2 archives
+// without FlagCodecs
+var ErrNotRecoverable = errors.New("archive has no entry frames")
+
+var errBadFrame = errors.New("bad entry header")
+
+// frameSize returns the size of the entry header of path, 0 without FlagRecovery
+func (aw *Writer) frameSize(path string) int64 {
+	if aw.flags&FlagRecovery == 0 {
+		return 0
+	}
+	n := frameHdrSize + entryHdrV2 + entryCodecExt + len(path)
+	if aw.keys != nil {
+		n += aw.keys.meta.NonceSize() + aw.keys.meta.Overhead()
+	}
+	return int64(n)
+}
+
+// writeFrame writes the entry header of fi at off, stored is the size of its stored bytes
+func (aw *Writer) writeFrame(off int64, fi *EntryInfo, stored int64) error {
+	if aw.flags&FlagRecovery == 0 {
+		return nil
+	}
+	rec := appendEntryV2(nil, fi, []byte(fi.Path), FlagCodecs)
+	if aw.keys != nil {
+		var err error
+		if rec, err = sealIndex(aw.keys.meta, rec, nil); err != nil {
+			return err
+		}
+	}
+
+	p := make([]byte, frameHdrSize, frameHdrSize+len(rec))
+	copy(p, frameMagic)
+	binary.BigEndian.PutUint32(p[4:8], uint32(len(rec)))
+	binary.BigEndian.PutUint64(p[8:16], uint64(stored))
+	if _, err := aw.w.Seek(off, 0); err != nil {
+		return err
+	}
+	_, err := aw.w.Write(append(p, rec...))
+	return err
+}
+
+// trailer returns the trailer of the index p, which is about to be written at off
+func (aw *Writer) trailer(h headerV2, p []byte, off int64) []byte {
+	h.indexOffset = uint64(off)
+	buf := append(append([]byte{}, p...), h.marshal()...)
+	return append(buf, aw.block...)
+}
+
+// readFrame reads the entry header at off, it returns the entry and the position and size
+// of its stored bytes
+func readFrame(r io.ReaderAt, off, size int64, keys *archiveKeys) (*EntryInfo, int64, int64, error) {
+	p := make([]byte, frameHdrSize)
+	if _, err := r.ReadAt(p, off); err != nil {
+		return nil, 0, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(p[4:8]))
+	stored := int64(binary.BigEndian.Uint64(p[8:16]))
+	start := off + frameHdrSize + n
+	if string(p[:4]) != frameMagic || n > frameMaxRec || stored < 0 || stored > size || start+stored > size {
+		return nil, 0, 0, errBadFrame
+	}
+
+	rec := make([]byte, n)
+	if _, err := r.ReadAt(rec, off+frameHdrSize); err != nil {
+		return nil, 0, 0, err
+	}
+	if keys != nil {
+		var err error
+		if rec, err = openIndex(keys.meta, rec, nil); err != nil {
+			return nil, 0, 0, errBadFrame
+		}
+	}
+
+	fi := &EntryInfo{}
+	rd := bytes.NewReader(rec)
+	path, err := readEntryV2(rd, fi, FlagCodecs)
+	if err != nil || rd.Len() != 0 || len(path) == 0 || fi.IsDir && stored != 0 {
+		return nil, 0, 0, errBadFrame
+	}
+	fi.Path = string(path)
+	return fi, start, stored, nil
+}
+
+// scanFrames calls fn at every occurrence of the entry header magic in r,
+// fn returns where the scan continues, which should be after off
+func scanFrames(r io.ReaderAt, size int64, fn func(off int64) int64) error {
+	buf := make([]byte, 1<<20)
+	magic := []byte(frameMagic)
+	base, n := int64(0), 0 // buf holds n bytes at base
+	for off := int64(0); off < size; {
+		if off < base || off+int64(len(magic)) > base+int64(n) {
+			var err error
+			if n, err = r.ReadAt(buf, off); err != nil && err != io.EOF {
+				return err
+			}
+			if base = off; n < len(magic) {
+				return nil
+			}
+		}
+
+		i := bytes.Index(buf[off-base:n], magic)
+		if i < 0 {
+			// the tail may be the beginning of a magic
+			off = base + int64(n-len(magic)+1)
+			continue
+		}
+		off = fn(off + int64(i))
+	}
+	return nil
+}
+
+// recoverCandidate is a copy of an entry found in the damaged archive
+type recoverCandidate struct {
+	a     *Archive
+	fi    *EntryInfo
+	start uint64
+	size  uint64
+}
+
+// Recover rebuilds the archive at path into w from whatever survives. Entries are taken from
+// the index, or the copy of it in the trailer if the beginning of the file is damaged.
+// If neither can be read, the file is scanned for entry headers, and the last header of a path
+// wins, so entries deleted by updates may come back. Every file is verified by its hash,
+// those failing it are returned as lost. Archives without FlagRecovery can only be recovered
+// if their index is intact, which is the same as compacting them, v1 archives can't be recovered
+func Recover(w io.WriteSeeker, path, password string) (recovered int, lost []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	size := st.Size()
+
+	// the key block is found first, it's needed by all others
+	var block []byte
+	var keys *archiveKeys
+	if password != "" {
+		for _, off := range []int64{HeaderV2Size, size - keyBlockSize} {
+			p := make([]byte, keyBlockSize)
+			if off < HeaderV2Size {
+				continue
+			}
+			if _, err := f.ReadAt(p, off); err != nil {
+				continue
+			}
+			if k, err := openKeyBlock(p, password); err == nil {
+				block, keys = p, k
+				break
+			}
+		}
+	}
+
+	// the index, then its copy
+	var sources []*Archive
+	for _, off := range []int64{0, size - HeaderV2Size, size - HeaderV2Size - keyBlockSize} {
+		if off < 0 {
+			continue
+		}
+		sr := io.NewSectionReader(f, 0, size)
+		sr.Seek(off, 0)
+		x, err := OpenArchiveBytes(sr, password, false)
+		if err != nil {
+			continue
+		}
+		if x.Version != FormatVersion || x.Flags&FlagCodecs == 0 {
+			return 0, nil, ErrNotRecoverable
+		}
+		if x.keys != nil && keys == nil {
+			return 0, nil, ErrUnrecoverable
+		}
+		// the password only applies to encrypted archives from here on
+		x.Fd, x.Size, x.Path, x.Info, x.Password = f, size, path, st, ""
+		sources = append(sources, x)
+	}
+
+	var order []string
+	cands := map[string][]recoverCandidate{}
+	created := time.Now()
+	if len(sources) > 0 {
+		created = sources[0].Created
+		for _, x := range sources {
+			for _, fi := range x.entries {
+				start, length, ok := x.Cursor.Get(fi.Path)
+				if !ok {
+					continue
+				}
+				if cands[fi.Path] == nil {
+					order = append(order, fi.Path)
+				}
+				cands[fi.Path] = append(cands[fi.Path], recoverCandidate{x, fi, start, length})
+			}
+		}
+	} else {
+		if password != "" && keys == nil {
+			return 0, nil, ErrUnrecoverable
+		}
+		x := &Archive{Fd: f, Size: size, Path: path, Info: st, Cursor: &Uint64OneTwoMap{}, Version: FormatVersion, keys: keys}
+		if err := scanFrames(f, size, func(off int64) int64 {
+			fi, start, stored, err := readFrame(f, off, size, keys)
+			if err != nil {
+				return off + 1
+			}
+			if cands[fi.Path] == nil {
+				order = append(order, fi.Path)
+			}
+			c := recoverCandidate{x, fi, uint64(start), uint64(stored)}
+			if fi.IsDir {
+				c.start, c.size = DirFlag, DirFlag
+			}
+			cands[fi.Path] = []recoverCandidate{c}
+			return start + stored
+		}); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(order) == 0 {
+		return 0, nil, ErrUnrecoverable
+	}
+
+	flags := FlagCodecs | FlagPathRefs | FlagRecovery
+	if keys != nil {
+		flags |= FlagEncrypted
+	}
+	aw, err := newWriter(w, created, flags, block, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, p := range order {
+		ok := false
+		for _, c := range cands[p] {
+			fi := *c.fi
+			switch c.start {
+			case DirFlag:
+				err = aw.WriteDir(&fi)
+			case ErrFlag:
+				err = aw.WriteError(&fi)
+			default:
+				err = aw.copyStored(c.a, c.fi, &fi, c.start, c.size, true)
+			}
+			if err == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			lost = append(lost, p)
+			continue
+		}
+		if c := cands[p][0]; c.start != DirFlag && c.start != ErrFlag {
+			recovered++
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return 0, nil, fmt.Errorf("can't write the recovered archive: %v", err)
+	}
+	return recovered, lost, nil
+}
@@ -0,0 +1,156 @@
+package arp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// The root hash is the root of a merkle tree over the header and every entry, leaves are:
+// sha256(0x00, (2b) version, (4b) flags without FlagSigned, (4b) total entries, (8b) created),
+// then sha256(0x00, metadata of the entry as in the index with the plain path, (8b) start, (8b) length)
+// in the order of the metadata. Nodes are sha256(0x01, left, right), the last node of an odd level
+// is carried up as is. Everything that changes what a reader sees changes the root, except
+// the offsets of the index and the signature block. Contents are covered by their hashes in the
+// metadata, so a valid signature doesn't mean valid contents until they are read, or checked
+// all at once by VerifyContents.
+// Signature block of FlagSigned archives:
+// (4b) magic: zzzs, (32b) ed25519 public key, (64b) signature of the root hash
+const (
+	sigMagic     = "zzzs"
+	sigBlockSize = 4 + ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+// ErrNotSigned indicates the archive has no signature
+var ErrNotSigned = errors.New("archive is not signed")
+
+// ErrBadSignature indicates the archive isn't signed by the trusted keys, or was modified after signing
+var ErrBadSignature = errors.New("bad signature")
+
+// Sign makes Close sign the archive with key. Archives updated later by NewAppendWriter lose
+// their signatures unless signed again, so do compacted, merged and recovered ones
+func (aw *Writer) Sign(key ed25519.PrivateKey) {
+	aw.signer = key
+}
+
+// rootHash computes the root hash, rows are the start and length of entries
+func rootHash(h headerV2, entries []*EntryInfo, rows [][2]uint64) [sha256.Size]byte {
+	level := make([][sha256.Size]byte, 0, len(entries)+1)
+
+	p := make([]byte, 1+2+4+4+8)
+	binary.BigEndian.PutUint16(p[1:3], h.version)
+	binary.BigEndian.PutUint32(p[3:7], h.flags&^FlagSigned)
+	binary.BigEndian.PutUint32(p[7:11], h.count)
+	binary.BigEndian.PutUint64(p[11:19], uint64(h.created))
+	level = append(level, sha256.Sum256(p))
+
+	for i, fi := range entries {
+		p = appendEntryV2(append(p[:0], 0), fi, []byte(fi.Path), h.flags)
+		p = append(p, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(p[len(p)-16:], rows[i][0])
+		binary.BigEndian.PutUint64(p[len(p)-8:], rows[i][1])
+		level = append(level, sha256.Sum256(p))
+	}
+
+	node := make([]byte, 1+2*sha256.Size)
+	node[0] = 1
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+			copy(node[1:], level[i][:])
+			copy(node[1+sha256.Size:], level[i+1][:])
+			next = append(next, sha256.Sum256(node))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func signBlock(key ed25519.PrivateKey, root [sha256.Size]byte) []byte {
+	p := append([]byte(sigMagic), key.Public().(ed25519.PublicKey)...)
+	return append(p, ed25519.Sign(key, root[:])...)
+}
+
+// RootHash returns the root hash of the archive, see sign.go for what it covers.
+// It needs the metadata, so archives opened with jmpTableOnly can't be hashed
+func (a *Archive) RootHash() ([sha256.Size]byte, error) {
+	if a.Version != FormatVersion {
+		return [sha256.Size]byte{}, ErrUnsupportedVersion
+	}
+	if a.infos == nil {
+		return [sha256.Size]byte{}, fmt.Errorf("can't hash the archive without metadata")
+	}
+
+	rows := make([][2]uint64, len(a.entries))
+	for i, fi := range a.entries {
+		start, length, _ := a.Cursor.Get(fi.Path)
+		rows[i] = [2]uint64{start, length}
+	}
+	h := headerV2{
+		version: uint16(a.Version),
+		flags:   a.Flags,
+		count:   uint32(len(a.Cursor.Data)),
+		created: unixNano(a.Created),
+	}
+	return rootHash(h, a.entries, rows), nil
+}
+
+// Signer returns the public key which signed the archive, whether it's trusted is up to callers.
+// It returns nil if the archive isn't signed
+func (a *Archive) Signer() ed25519.PublicKey {
+	if a.Flags&FlagSigned == 0 || len(a.sig) != sigBlockSize || string(a.sig[:4]) != sigMagic {
+		return nil
+	}
+	return ed25519.PublicKey(a.sig[4 : 4+ed25519.PublicKeySize])
+}
+
+// Verify checks the archive is signed by pub and hasn't been modified since
+func (a *Archive) Verify(pub ed25519.PublicKey) error {
+	return a.VerifyAny([]ed25519.PublicKey{pub})
+}
+
+// VerifyContents reads every file and checks it against its hash, together with Verify it
+// makes sure nothing in the archive is modified since signing
+func (a *Archive) VerifyContents() error {
+	if a.infos == nil {
+		return fmt.Errorf("can't verify the archive without metadata")
+	}
+	for _, fi := range a.entries {
+		if _, _, ok := a.GetFile(fi.Path); !ok {
+			continue
+		}
+		if _, err := a.Stream(ioutil.Discard, fi.Path); err != nil {
+			return fmt.Errorf("%s: %w", fi.Path, err)
+		}
+	}
+	return nil
+}
+
+// VerifyAny checks the archive is signed by any of the trusted keys and hasn't been modified since
+func (a *Archive) VerifyAny(trusted []ed25519.PublicKey) error {
+	signer := a.Signer()
+	if signer == nil {
+		return ErrNotSigned
+	}
+	root, err := a.RootHash()
+	if err != nil {
+		return err
+	}
+	for _, pub := range trusted {
+		if bytes.Equal(pub, signer) {
+			if ed25519.Verify(pub, root[:], a.sig[4+ed25519.PublicKeySize:]) {
+				return nil
+			}
+			break
+		}
+	}
+	return ErrBadSignature
+}
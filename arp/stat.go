@@ -0,0 +1,34 @@
+package arp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// NewEntryInfo builds the entry of path from its file info, the hash is left empty
+func NewEntryInfo(path string, st os.FileInfo) *EntryInfo {
+	fi := &EntryInfo{
+		Path:    path,
+		Modtime: st.ModTime(),
+		Mode:    uint32(st.Mode()),
+		IsDir:   st.IsDir(),
+	}
+	fi.Atime, fi.Ctime = fileTimes(st)
+	return fi
+}
+
+// Unchanged tells whether the file described by st is the same as the entry by modtime and size
+func (fi *EntryInfo) Unchanged(st os.FileInfo) bool {
+	return !fi.IsDir && !st.IsDir() && fi.Modtime.Equal(st.ModTime()) && fi.Size == st.Size()
+}
+
+// SameContent tells whether the content read from r is the same as the entry by hash
+func (fi *EntryInfo) SameContent(r io.Reader) (bool, error) {
+	n, h, err := HashCopy(ioutil.Discard, r)
+	if err != nil {
+		return false, err
+	}
+	return !fi.IsDir && n == fi.Size && bytes.Equal(h, fi.Hash[:]), nil
+}
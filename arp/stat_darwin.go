@@ -0,0 +1,15 @@
+package arp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileTimes(st os.FileInfo) (atime, ctime time.Time) {
+	s, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return st.ModTime(), st.ModTime()
+	}
+	return time.Unix(s.Atimespec.Sec, s.Atimespec.Nsec), time.Unix(s.Ctimespec.Sec, s.Ctimespec.Nsec)
+}
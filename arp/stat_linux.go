@@ -0,0 +1,15 @@
+package arp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileTimes(st os.FileInfo) (atime, ctime time.Time) {
+	s, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return st.ModTime(), st.ModTime()
+	}
+	return time.Unix(int64(s.Atim.Sec), int64(s.Atim.Nsec)), time.Unix(int64(s.Ctim.Sec), int64(s.Ctim.Nsec))
+}
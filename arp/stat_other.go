@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package arp
+
+import (
+	"os"
+	"time"
+)
+
+// fileTimes falls back to the modtime where atime and ctime are unavailable
+func fileTimes(st os.FileInfo) (atime, ctime time.Time) {
+	return st.ModTime(), st.ModTime()
+}
@@ -0,0 +1,61 @@
+package arp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// TranscodeManifest is the path of the entry recording the original info of files
+// which were transcoded into webp during archiving
+const TranscodeManifest = ".arr.transcoded"
+
+// TranscodeInfo records the original file of a transcoded entry
+type TranscodeInfo struct {
+	MIME string
+	Size int64
+	Hash [sha256.Size]byte
+}
+
+type transcodeInfoJSON struct {
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+	Hash string `json:"sha256"`
+}
+
+func (t *TranscodeInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(transcodeInfoJSON{t.MIME, t.Size, hex.EncodeToString(t.Hash[:])})
+}
+
+func (t *TranscodeInfo) UnmarshalJSON(p []byte) error {
+	x := transcodeInfoJSON{}
+	if err := json.Unmarshal(p, &x); err != nil {
+		return err
+	}
+	h, err := hex.DecodeString(x.Hash)
+	if err != nil {
+		return err
+	}
+	t.MIME, t.Size = x.MIME, x.Size
+	copy(t.Hash[:], h)
+	return nil
+}
+
+// TranscodeInfos reads the transcode manifest, it returns nil if the archive has none
+func (a *Archive) TranscodeInfos() (map[string]*TranscodeInfo, error) {
+	if _, _, ok := a.GetFile(TranscodeManifest); !ok {
+		return nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := a.Stream(buf, TranscodeManifest); err != nil {
+		return nil, err
+	}
+
+	m := map[string]*TranscodeInfo{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
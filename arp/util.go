@@ -3,7 +3,9 @@ package arp
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"hash"
 	"io"
 )
@@ -15,9 +17,8 @@ type hashreader struct {
 
 func (h *hashreader) Read(p []byte) (int, error) {
 	n, err := h.r.Read(p)
-	if err == nil {
-		h.s.Write(p[:n])
-	}
+	// readers may return the last bytes along with io.EOF
+	h.s.Write(p[:n])
 	return n, err
 }
 
@@ -62,6 +63,8 @@ func (cr *IOWrapperAES) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// WrapReaderWriter is the AES-CTR wrapper used by v1 archives, it is kept for reading them.
+// New archives are encrypted by AES-GCM with derived keys, see crypt.go
 func WrapReaderWriter(r io.Reader, w io.Writer, password string) *IOWrapperAES {
 	cr := &IOWrapperAES{r: r, w: w}
 	if password == "" {
@@ -74,3 +77,33 @@ func WrapReaderWriter(r io.Reader, w io.Writer, password string) *IOWrapperAES {
 	cr.s = cipher.NewCTR(blk, []byte("                "))
 	return cr
 }
+
+// pbkdf2 derives a key from password with HMAC-SHA256, see RFC 8018
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
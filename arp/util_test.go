@@ -34,3 +34,24 @@ func TestHashCopy(t *testing.T) {
 	}
 
 }
+
+func TestPBKDF2(t *testing.T) {
+	for _, c := range []struct {
+		iter int
+		want string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		if got := fmt.Sprintf("%x", pbkdf2([]byte("password"), []byte("salt"), c.iter, 32)); got != c.want {
+			t.Errorf("iter %d: got %s, want %s", c.iter, got, c.want)
+		}
+	}
+
+	// keys longer than a single block
+	got := fmt.Sprintf("%x", pbkdf2([]byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 40))
+	if want := "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
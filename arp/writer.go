@@ -0,0 +1,407 @@
+package arp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNotAppendable indicates the archive was written by an older version and can't be updated
+var ErrNotAppendable = errors.New("archive can't be updated, please re-archive it")
+
+// Writer writes a v2 archive, file contents are appended as they come,
+// the jmptable and metadata are written by Close
+type Writer struct {
+	// Policy chooses the codec of every file, nil means no compression
+	Policy CodecPolicy
+
+	w       io.WriteSeeker
+	keys    *archiveKeys
+	block   []byte // the key block, copied into the trailer
+	created time.Time
+	flags   uint32
+	cursor  int64
+	entries []*EntryInfo
+	rows    [][2]uint64     // start and length of entries, or DirFlag/ErrFlag
+	index   map[string]int  // position of paths in entries
+	written map[string]bool // paths written by this writer
+	collide int
+	base    *Archive
+	signer  ed25519.PrivateKey
+}
+
+// NewWriter starts a new archive in w, which should be empty.
+// A non-empty password encrypts the archive
+func NewWriter(w io.WriteSeeker, password string) (*Writer, error) {
+	flags := FlagCodecs | FlagPathRefs | FlagRecovery
+	var block []byte
+	var keys *archiveKeys
+	if password != "" {
+		var err error
+		if block, keys, err = newKeyBlock(password); err != nil {
+			return nil, err
+		}
+		flags |= FlagEncrypted
+	}
+	return newWriter(w, time.Now(), flags, block, keys)
+}
+
+// newWriter writes the placeholder of the header and the key block, if any
+func newWriter(w io.WriteSeeker, created time.Time, flags uint32, block []byte, keys *archiveKeys) (*Writer, error) {
+	aw := &Writer{
+		w:       w,
+		keys:    keys,
+		block:   block,
+		created: created,
+		flags:   flags,
+		cursor:  HeaderV2Size + int64(len(block)),
+		index:   map[string]int{},
+		written: map[string]bool{},
+	}
+	// the header will be rewritten by Close
+	if _, err := w.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(make([]byte, HeaderV2Size), block...)); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// NewAppendWriter opens the archive in f, which must be opened for reading and writing,
+// to add or replace entries. New contents and then a new index are appended to the end,
+// old ones are left in place until the archive is compacted. The header is rewritten last,
+// so if the update fails midway, readers still see the previous index
+func NewAppendWriter(f *os.File, password string) (*Writer, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	x, err := OpenArchiveBytes(f, password, false)
+	if err != nil {
+		return nil, err
+	}
+	if x.Version != FormatVersion || x.Flags&FlagCodecs == 0 || (password != "" && x.keys == nil) {
+		return nil, ErrNotAppendable
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	x.Fd, x.Size, x.Path, x.Info = f, st.Size(), f.Name(), st
+	block, err := x.keyBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	aw := &Writer{
+		w:       f,
+		keys:    x.keys,
+		block:   block,
+		created: x.Created,
+		flags:   x.Flags | FlagPathRefs | FlagRecovery,
+		cursor:  st.Size(),
+		index:   map[string]int{},
+		written: map[string]bool{},
+		base:    x,
+	}
+	for _, fi := range x.entries {
+		if _, ok := aw.index[fi.Path]; ok {
+			continue
+		}
+		start, length, _ := x.Cursor.Get(fi.Path)
+		aw.index[fi.Path] = len(aw.entries)
+		aw.entries = append(aw.entries, fi)
+		aw.rows = append(aw.rows, [2]uint64{start, length})
+	}
+	return aw, nil
+}
+
+// Base returns the archive opened by NewAppendWriter as it was before the update,
+// nil for new archives
+func (aw *Writer) Base() *Archive {
+	return aw.base
+}
+
+// Lookup returns the entry of path written so far, including those carried over by
+// NewAppendWriter. Entries which failed to be archived are not returned
+func (aw *Writer) Lookup(path string) (*EntryInfo, bool) {
+	i, ok := aw.index[path]
+	if !ok || aw.rows[i][0] == ErrFlag {
+		return nil, false
+	}
+	return aw.entries[i], true
+}
+
+// Delete drops the entry of path, it returns false if there's no such entry.
+// The content is left in the file until the archive is compacted
+func (aw *Writer) Delete(path string) bool {
+	i, ok := aw.index[path]
+	if !ok {
+		return false
+	}
+	aw.entries[i] = nil
+	delete(aw.index, path)
+	delete(aw.written, path)
+	return true
+}
+
+// Collisions returns the number of paths whose hash collided with an earlier one,
+// they are still looked up correctly but a little slower. It's counted by Close
+func (aw *Writer) Collisions() int {
+	return aw.collide
+}
+
+func (aw *Writer) checkPath(path string) error {
+	if aw.written[path] {
+		return ErrDuplicatePath
+	}
+	return nil
+}
+
+// push adds the entry, or replaces the one carried over from the archive being updated
+func (aw *Writer) push(fi *EntryInfo, v, l uint64) {
+	if i, ok := aw.index[fi.Path]; ok {
+		aw.entries[i], aw.rows[i] = fi, [2]uint64{v, l}
+	} else {
+		aw.index[fi.Path] = len(aw.entries)
+		aw.entries = append(aw.entries, fi)
+		aw.rows = append(aw.rows, [2]uint64{v, l})
+	}
+	aw.written[fi.Path] = true
+}
+
+// WriteDir adds a directory entry
+func (aw *Writer) WriteDir(fi *EntryInfo) error {
+	if err := aw.checkPath(fi.Path); err != nil {
+		return err
+	}
+	fi.IsDir = true
+	copy(fi.Hash[:], DirGUID)
+	if err := aw.writeFrame(aw.cursor, fi, 0); err != nil {
+		return err
+	}
+	aw.cursor += aw.frameSize(fi.Path)
+	aw.push(fi, DirFlag, DirFlag)
+	return nil
+}
+
+// WriteError adds an entry which failed to be archived, it can't be streamed later
+func (aw *Writer) WriteError(fi *EntryInfo) error {
+	if err := aw.checkPath(fi.Path); err != nil {
+		return err
+	}
+	aw.push(fi, ErrFlag, ErrFlag)
+	return nil
+}
+
+// WriteFile appends the content of r as fi, fi.Hash, fi.Size and fi.Codec will be filled.
+// If the compressed result isn't smaller, the file will be stored as is, which requires r
+// to be an io.Seeker, otherwise the compressed one will be kept.
+// If the copying fails, the entry won't be added and the written bytes will be reused
+func (aw *Writer) WriteFile(fi *EntryInfo, r io.Reader) (int64, error) {
+	if err := aw.checkPath(fi.Path); err != nil {
+		return 0, err
+	}
+
+	// the entry header goes before the content, once the hash is known
+	frame := aw.cursor
+	aw.cursor += aw.frameSize(fi.Path)
+	stored, err := aw.writeContent(fi, r)
+	if err == nil {
+		err = aw.writeFrame(frame, fi, stored)
+	}
+	if err != nil {
+		aw.cursor = frame
+		return 0, err
+	}
+	aw.push(fi, uint64(aw.cursor), uint64(stored))
+	aw.cursor += stored
+	return stored, nil
+}
+
+// writeContent writes the content of r at cursor and fills fi, see WriteFile
+func (aw *Writer) writeContent(fi *EntryInfo, r io.Reader) (int64, error) {
+	var origin int64 = -1
+	if s, ok := r.(io.Seeker); ok {
+		if pos, err := s.Seek(0, 1); err == nil {
+			origin = pos
+		}
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	head = head[:n]
+
+	codec := CodecNone
+	if aw.Policy != nil {
+		codec = aw.Policy(fi.Path, head)
+	}
+
+	size, compressed, stored, h, err := aw.copy(io.MultiReader(bytes.NewReader(head), r), codec)
+	if err != nil {
+		return 0, err
+	}
+
+	if codec != CodecNone && compressed >= size && origin >= 0 {
+		if _, err := r.(io.Seeker).Seek(origin, 0); err != nil {
+			return 0, err
+		}
+		codec = CodecNone
+		if size, _, stored, h, err = aw.copy(r, codec); err != nil {
+			return 0, err
+		}
+	}
+
+	copy(fi.Hash[:], h)
+	fi.Size, fi.Codec = size, codec
+	return stored, nil
+}
+
+// copy compresses and encrypts r into the archive at cursor, it returns the original size,
+// the compressed size, the stored size and the hash of the original content
+func (aw *Writer) copy(r io.Reader, codec Codec) (size, compressed, stored int64, h []byte, err error) {
+	if _, err = aw.w.Seek(aw.cursor, 0); err != nil {
+		return
+	}
+
+	sw := &countWriter{w: aw.w}
+	var sealer io.WriteCloser = nopWriteCloser{sw}
+	if aw.keys != nil {
+		if sealer, err = newSealWriter(sw, aw.keys); err != nil {
+			return
+		}
+	}
+
+	cw := &countWriter{w: sealer}
+	c, err := compressor(codec, cw)
+	if err != nil {
+		return
+	}
+
+	if size, h, err = HashCopy(c, r); err != nil {
+		return
+	}
+	if err = c.Close(); err != nil {
+		return
+	}
+	if err = sealer.Close(); err != nil {
+		return
+	}
+	return size, cw.n, sw.n, h, nil
+}
+
+// Close writes the jmptable, metadata and header, w won't be closed
+func (aw *Writer) Close() error {
+	m := Uint64OneTwoMap{}
+	live := make([]*EntryInfo, 0, len(aw.entries))
+	rows := make([][2]uint64, 0, len(aw.entries))
+	for i, fi := range aw.entries {
+		if fi != nil {
+			m.Push(fi.Path, aw.rows[i][0], aw.rows[i][1])
+			live = append(live, fi)
+			rows = append(rows, aw.rows[i])
+		}
+	}
+	m.Seal()
+	aw.collide = 0
+	for i := 1; i < len(m.Data); i++ {
+		if m.Data[i][0] == m.Data[i-1][0] {
+			aw.collide++
+		}
+	}
+
+	index := bytes.Buffer{}
+	index.Write(m.Bytes())
+
+	buf := []byte{}
+	for _, fi := range live {
+		// paths are protected along with the whole index in encrypted archives
+		buf = appendEntryV2(buf[:0], fi, []byte(fi.Path), aw.flags)
+		index.Write(buf)
+	}
+	for _, o := range m.order {
+		binary.BigEndian.PutUint32(buf[:4], uint32(o))
+		index.Write(buf[:4])
+	}
+
+	// the signature of the updated archive is gone, unless it's signed again
+	p := index.Bytes()
+	h := headerV2{
+		version:     FormatVersion,
+		flags:       aw.flags &^ FlagSigned,
+		count:       uint32(len(live)),
+		created:     unixNano(aw.created),
+		indexOffset: uint64(aw.cursor),
+		indexSize:   uint64(len(p)),
+	}
+	var block []byte
+	if aw.signer != nil {
+		block = signBlock(aw.signer, rootHash(h, live, rows))
+		h.flags |= FlagSigned
+	}
+	if aw.keys != nil {
+		// the header is sealed along with the index, so it must be complete by now
+		h.indexSize = uint64(sealedSize(aw.keys.meta, len(p)))
+		var err error
+		if p, err = sealIndex(aw.keys.meta, p, indexAD(h)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := aw.w.Seek(aw.cursor, 0); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(p); err != nil {
+		return err
+	}
+	end := aw.cursor + int64(len(p))
+	if block != nil {
+		if _, err := aw.w.Write(block); err != nil {
+			return err
+		}
+		h.sigOffset = uint64(end)
+		end += int64(len(block))
+	}
+	if aw.flags&FlagRecovery != 0 {
+		trailer := aw.trailer(h, p, end)
+		if _, err := aw.w.Write(trailer); err != nil {
+			return err
+		}
+		end += int64(len(trailer))
+	}
+
+	// drop the leftover of failed copies, if possible
+	if t, ok := aw.w.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	// the index must be on the disk before the header points to it
+	if err := syncWriter(aw.w); err != nil {
+		return err
+	}
+
+	if _, err := aw.w.Seek(0, 0); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(h.marshal()); err != nil {
+		return err
+	}
+	return syncWriter(aw.w)
+}
+
+func syncWriter(w io.Writer) error {
+	if s, ok := w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
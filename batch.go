@@ -0,0 +1,279 @@
+package gowebp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BatchJob is a single job of Batch, Src can be webp or any format registered to the image package
+type BatchJob struct {
+	Src     io.Reader
+	Options *EncoderOptions
+	Dst     io.Writer
+}
+
+// BatchStats holds the stats of a finished job
+type BatchStats struct {
+	Width, Height int
+	InBytes       int64
+	OutBytes      int64
+	Duration      time.Duration
+}
+
+// BatchResult is the result of a job, Index is the position of the job in the input
+type BatchResult struct {
+	Index int
+	Job   BatchJob
+	Stats BatchStats
+	Err   error
+}
+
+// Batch re-encodes images into webp concurrently
+type Batch struct {
+	// Workers is the number of concurrent jobs, 0 means runtime.NumCPU()
+	Workers int
+	// MaxPixels caps the total pixels of images being decoded and encoded at once,
+	// 0 means unlimited. An image larger than MaxPixels, or of unknown size, will run alone.
+	// Only the header of Src is read while a job waits for its share
+	MaxPixels int64
+	// Ordered emits the results in the input order
+	Ordered bool
+}
+
+// Run reads jobs until the channel is closed or ctx is done, and returns a channel of results
+// which will be closed after all jobs finished. Jobs taken but not started before ctx is done
+// will be reported with ctx.Err(), the rest are left in the channel. Once ctx is done, results
+// nobody receives are dropped, so callers can stop receiving without leaking goroutines
+func (b *Batch) Run(ctx context.Context, jobs <-chan BatchJob) <-chan BatchResult {
+	workers := b.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	type indexedJob struct {
+		index int
+		job   BatchJob
+	}
+
+	in := make(chan indexedJob)
+	results := make(chan BatchResult, workers)
+	budget := &pixelBudget{max: b.MaxPixels}
+
+	go func() {
+		defer close(in)
+		for i := 0; ; i++ {
+			select {
+			case job, ok := <-jobs:
+				if !ok {
+					return
+				}
+				select {
+				case in <- indexedJob{i, job}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range in {
+				res := BatchResult{Index: j.index, Job: j.job}
+				if err := ctx.Err(); err != nil {
+					res.Err = err
+				} else {
+					res.Stats, res.Err = runJob(ctx, j.job, budget)
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					// the caller may not be receiving anymore, try once and move on
+					select {
+					case results <- res:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if !b.Ordered {
+		return results
+	}
+
+	ordered := make(chan BatchResult, workers)
+	go func() {
+		defer close(ordered)
+		next, pending := 0, map[int]BatchResult{}
+		for res := range results {
+			pending[res.Index] = res
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				select {
+				case ordered <- r:
+				case <-ctx.Done():
+					return
+				}
+				next++
+			}
+		}
+	}()
+	return ordered
+}
+
+func runJob(ctx context.Context, job BatchJob, budget *pixelBudget) (stats BatchStats, err error) {
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+
+	if job.Src == nil || job.Dst == nil {
+		return stats, errors.New("batch: nil source or destination")
+	}
+
+	// only the header is read before the budget is acquired, so waiting jobs hold no image data
+	head := &bytes.Buffer{}
+	src := io.TeeReader(job.Src, head)
+	if _, err := io.CopyN(ioutil.Discard, src, batchHeaderSize); err != nil && err != io.EOF {
+		return stats, err
+	}
+
+	isWebp := isWebpHeader(head.Bytes())
+	if isWebp {
+		stats.Width, stats.Height = webpHeaderSize(head.Bytes())
+	} else {
+		config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head.Bytes()), src))
+		if err != nil {
+			return stats, err
+		}
+		stats.Width, stats.Height = config.Width, config.Height
+	}
+
+	pixels := int64(stats.Width) * int64(stats.Height)
+	if pixels <= 0 {
+		// the size is unknown until decoded, so the job takes the whole budget and runs alone
+		pixels = budget.max
+	}
+	if err := budget.acquire(ctx, pixels); err != nil {
+		return stats, err
+	}
+	defer budget.release(pixels)
+
+	if _, err := head.ReadFrom(job.Src); err != nil {
+		return stats, err
+	}
+	buf := head.Bytes()
+	stats.InBytes = int64(len(buf))
+
+	var img image.Image
+	if isWebp {
+		img, err = DecodeWithOptions(buf, nil)
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return stats, err
+	}
+	stats.Width, stats.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	buf, head = nil, nil
+
+	w := &countWriter{w: job.Dst}
+	err = Encode(w, img, job.Options)
+	stats.OutBytes = w.n
+	return stats, err
+}
+
+// batchHeaderSize is how much of Src is read for the size of a webp, enough for VP8X, VP8 and VP8L
+const batchHeaderSize = 64
+
+func isWebpHeader(p []byte) bool {
+	return len(p) >= 16 && string(p[:4]) == "RIFF" && string(p[8:12]) == "WEBP"
+}
+
+// webpHeaderSize returns the canvas size from the beginning of a webp. WebPGetInfo needs the
+// whole ALPH chunk before VP8 in extended files, so the VP8X chunk is read here instead
+func webpHeaderSize(p []byte) (width, height int) {
+	if len(p) >= 30 && string(p[12:16]) == "VP8X" {
+		width = 1 + (int(p[24]) | int(p[25])<<8 | int(p[26])<<16)
+		height = 1 + (int(p[27]) | int(p[28])<<8 | int(p[29])<<16)
+		return width, height
+	}
+	return webpSize(p)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// pixelBudget is a weighted semaphore, waiters are woken up by closing wait on every release
+type pixelBudget struct {
+	mu   sync.Mutex
+	max  int64
+	cur  int64
+	wait chan struct{}
+}
+
+func (b *pixelBudget) acquire(ctx context.Context, n int64) error {
+	if b.max <= 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		if b.cur == 0 || b.cur+n <= b.max {
+			b.cur += n
+			b.mu.Unlock()
+			return nil
+		}
+		if b.wait == nil {
+			b.wait = make(chan struct{})
+		}
+		wait := b.wait
+		b.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *pixelBudget) release(n int64) {
+	if b.max <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.cur -= n
+	if b.wait != nil {
+		close(b.wait)
+		b.wait = nil
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,243 @@
+package gowebp
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func encodePattern(t *testing.T, w, h int, opts *EncoderOptions) []byte {
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, testPattern(w, h), opts); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBatchOrdered(t *testing.T) {
+	pngBuf := &bytes.Buffer{}
+	if err := png.Encode(pngBuf, testPattern(40, 30)); err != nil {
+		t.Fatal(err)
+	}
+	alpha := testPattern(24, 20)
+	alpha.Pix[3] = 100
+
+	// webp with VP8X + ALPH, lossless, PNG, in decreasing sizes so later jobs tend to finish first
+	sources := [][]byte{pngBuf.Bytes()}
+	lossyAlpha := &bytes.Buffer{}
+	if err := Encode(lossyAlpha, alpha, &EncoderOptions{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	sources = append(sources, lossyAlpha.Bytes())
+	for i := 8; i > 0; i-- {
+		sources = append(sources, encodePattern(t, i*16, i*8, &EncoderOptions{Quality: 100, Lossless: true}))
+	}
+	if string(lossyAlpha.Bytes()[12:16]) != "VP8X" {
+		t.Fatalf("expected an extended webp, got %q", lossyAlpha.Bytes()[12:16])
+	}
+
+	jobs := make(chan BatchJob, len(sources))
+	dsts := make([]*bytes.Buffer, len(sources))
+	for i, src := range sources {
+		dsts[i] = &bytes.Buffer{}
+		jobs <- BatchJob{Src: bytes.NewReader(src), Options: &EncoderOptions{Quality: 75}, Dst: dsts[i]}
+	}
+	close(jobs)
+
+	b := &Batch{Workers: 4, Ordered: true}
+	next := 0
+	for res := range b.Run(context.Background(), jobs) {
+		if res.Index != next {
+			t.Fatalf("expected result %d, got %d", next, res.Index)
+		}
+		next++
+		if res.Err != nil {
+			t.Fatalf("job %d: %v", res.Index, res.Err)
+		}
+		if res.Stats.InBytes != int64(len(sources[res.Index])) || res.Stats.OutBytes != int64(dsts[res.Index].Len()) {
+			t.Errorf("job %d: bad stats %+v", res.Index, res.Stats)
+		}
+		img, err := DecodeWithOptions(dsts[res.Index].Bytes(), nil)
+		if err != nil {
+			t.Fatalf("job %d: %v", res.Index, err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() != res.Stats.Width || bounds.Dy() != res.Stats.Height {
+			t.Errorf("job %d: expected %dx%d, got %v", res.Index, res.Stats.Width, res.Stats.Height, bounds)
+		}
+	}
+	if next != len(sources) {
+		t.Fatalf("expected %d results, got %d", len(sources), next)
+	}
+}
+
+func TestBatchErrors(t *testing.T) {
+	good := encodeFill(t, 8, 8, color.NRGBA{0, 0, 255, 255})
+	jobs := make(chan BatchJob, 4)
+	jobs <- BatchJob{Src: bytes.NewReader(good), Dst: &bytes.Buffer{}}
+	jobs <- BatchJob{Src: bytes.NewReader([]byte("not an image")), Dst: &bytes.Buffer{}}
+	jobs <- BatchJob{Src: bytes.NewReader(good)}
+	jobs <- BatchJob{Src: bytes.NewReader(good), Dst: &bytes.Buffer{}}
+	close(jobs)
+
+	failed := map[int]bool{}
+	n := 0
+	for res := range (&Batch{Workers: 2}).Run(context.Background(), jobs) {
+		n++
+		failed[res.Index] = res.Err != nil
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 results, got %d", n)
+	}
+	for i, want := range []bool{false, true, true, false} {
+		if failed[i] != want {
+			t.Errorf("job %d: expected failure %v, got %v", i, want, failed[i])
+		}
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	src := encodePattern(t, 64, 64, &EncoderOptions{Quality: 75})
+	base := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan BatchJob)
+	sent := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() { sent <- n }()
+		for ; n < 1000; n++ {
+			select {
+			case jobs <- BatchJob{Src: bytes.NewReader(src), Dst: ioutil.Discard}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := (&Batch{Workers: 2, Ordered: true}).Run(ctx, jobs)
+	for i := 0; i < 3; i++ {
+		if res := <-results; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	cancel()
+	if n := <-sent; n == 1000 {
+		t.Fatal("jobs were still taken after cancel")
+	}
+
+	// nobody receives the results anymore, every goroutine should exit anyway
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leaked:\n%s", buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for range results {
+	}
+}
+
+// trackReader counts the job as active once it's read past the header
+type trackReader struct {
+	r       *bytes.Reader
+	off     int
+	started bool
+	t       *concurrency
+}
+
+func (r *trackReader) Read(p []byte) (int, error) {
+	if r.off >= batchHeaderSize && !r.started {
+		r.started = true
+		r.t.enter()
+		time.Sleep(20 * time.Millisecond)
+	}
+	n, err := r.r.Read(p)
+	r.off += n
+	return n, err
+}
+
+// trackWriter counts the job as done at its first write
+type trackWriter struct {
+	done bool
+	t    *concurrency
+}
+
+func (w *trackWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		w.t.leave()
+	}
+	return len(p), nil
+}
+
+type concurrency struct {
+	mu       sync.Mutex
+	cur, max int
+}
+
+func (c *concurrency) enter() {
+	c.mu.Lock()
+	if c.cur++; c.cur > c.max {
+		c.max = c.cur
+	}
+	c.mu.Unlock()
+}
+
+func (c *concurrency) leave() {
+	c.mu.Lock()
+	c.cur--
+	c.mu.Unlock()
+}
+
+func TestBatchMaxPixels(t *testing.T) {
+	src := encodePattern(t, 64, 64, &EncoderOptions{Quality: 100, Lossless: true})
+	if len(src) <= batchHeaderSize {
+		t.Fatalf("source too small: %d bytes", len(src))
+	}
+
+	for _, tc := range []struct {
+		maxPixels int64
+		want      int
+	}{
+		{2 * 64 * 64, 2},
+		{64 * 64, 1},
+		{100, 1}, // larger images run alone
+	} {
+		c := &concurrency{}
+		jobs := make(chan BatchJob, 8)
+		for i := 0; i < 8; i++ {
+			jobs <- BatchJob{Src: &trackReader{r: bytes.NewReader(src), t: c}, Dst: &trackWriter{t: c}}
+		}
+		close(jobs)
+
+		for res := range (&Batch{Workers: 8, MaxPixels: tc.maxPixels}).Run(context.Background(), jobs) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+		}
+		if c.max > tc.want {
+			t.Errorf("MaxPixels %d: expected at most %d jobs at once, got %d", tc.maxPixels, tc.want, c.max)
+		}
+	}
+}
+
+func TestBatchUnknownSize(t *testing.T) {
+	budget := &pixelBudget{max: 100}
+	budget.acquire(context.Background(), 1)
+
+	// the size of a broken webp can't be read, it must wait for the whole budget anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	src := []byte("RIFF\x00\x01\x00\x00WEBPVP8 \x00\x00\x01\x00")
+	job := BatchJob{Src: bytes.NewReader(src), Dst: ioutil.Discard}
+	if _, err := runJob(ctx, job, budget); err != context.DeadlineExceeded {
+		t.Fatal("expect context.DeadlineExceeded, got", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/coyove/gowebp/arp"
+)
+
+// matchEntry tells whether the path or any of its parent directories matches the pattern
+func matchEntry(pattern, p string) bool {
+	for ; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteEntries drops the entries matching pattern from the archive, matching a directory
+// drops everything under it. The contents are left in the file until the archive is compacted
+func DeleteEntries(arpath, pattern, password string) {
+	_, err := path.Match(pattern, "")
+	fmtFatalErr(err)
+
+	f, err := os.OpenFile(arpath, os.O_RDWR, 0)
+	fmtFatalErr(err)
+	defer f.Close()
+
+	aw, err := arp.NewAppendWriter(f, password)
+	fmtFatalErr(err)
+
+	base := aw.Base()
+	manifest, err := base.TranscodeInfos()
+	fmtFatalErr(err)
+
+	var count int
+	var size uint64
+	for _, fi := range base.Entries() {
+		if fi.Path == arp.TranscodeManifest || !matchEntry(pattern, fi.Path) {
+			continue
+		}
+		if _, l, ok := base.GetFile(fi.Path); ok {
+			size += l
+		}
+		aw.Delete(fi.Path)
+		delete(manifest, fi.Path)
+		fmtPrintln("Deleted:", fi.Path)
+		count++
+	}
+
+	if count == 0 {
+		fmtPrintln("No entries match", pattern)
+		return
+	}
+	if manifest != nil {
+		writeManifest(aw, manifest)
+	}
+	fmtFatalErr(aw.Close())
+	fmtPrintf("\nDeleted %d entries, run 'arr compact' to reclaim %s\n", count, humansize(int64(size)))
+}
+
+// CompactArchive rewrites the archive with only the live entries
+func CompactArchive(arpath, password string) {
+	o := newoneliner()
+	fmtPrintln("Compacting:", arpath)
+
+	n, err := arp.Compact(arpath, password)
+	fmtFatalErr(err)
+	fmtPrintln("Finished in", o.elapsed(), ", reclaimed:", n, "bytes /", humansize(n))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coyove/gowebp/arp"
+)
+
+// diffItem is an entry of the archive or a file on the disk being compared
+type diffItem struct {
+	IsDir   bool
+	Mode    os.FileMode
+	Size    int64
+	Modtime time.Time
+	bad     bool // entries which failed to be archived
+	coarse  bool // v1 archives store modtime in seconds
+	hash    func() ([sha256.Size]byte, error)
+}
+
+type diffEntry struct {
+	Dir     bool      `json:"dir"`
+	Mode    string    `json:"mode"`
+	Size    int64     `json:"size"`
+	Modtime time.Time `json:"modtime"`
+}
+
+// diffChange is a difference, Change is one of added, removed, modified, mode and type
+type diffChange struct {
+	Path   string     `json:"path"`
+	Change string     `json:"change"`
+	Old    *diffEntry `json:"old,omitempty"`
+	New    *diffEntry `json:"new,omitempty"`
+}
+
+func (it *diffItem) entry() *diffEntry {
+	if it == nil {
+		return nil
+	}
+	return &diffEntry{Dir: it.IsDir, Mode: it.Mode.String(), Size: it.Size, Modtime: it.Modtime}
+}
+
+// archiveItems lists the archive, images transcoded into webp are listed as their originals
+// so they can be compared with the disk. Hashes are the stored ones
+func archiveItems(a *arp.Archive) (map[string]*diffItem, error) {
+	transcoded, err := a.TranscodeInfos()
+	if err != nil {
+		return nil, err
+	}
+
+	items := map[string]*diffItem{}
+	for _, fi := range a.Entries() {
+		if fi.Path == arp.TranscodeManifest {
+			continue
+		}
+		fi := fi
+		it := &diffItem{IsDir: fi.IsDir, Mode: os.FileMode(fi.Mode), Size: fi.Size, Modtime: fi.Modtime, coarse: a.Version == 1}
+		it.hash = func() ([sha256.Size]byte, error) { return a.ContentHash(fi.Path) }
+		if start, _, ok := a.Cursor.Get(fi.Path); ok && start == arp.ErrFlag {
+			it.bad = true
+		}
+
+		path := fi.Path
+		if t := transcoded[path]; t != nil {
+			path = strings.TrimSuffix(path, webpSuffix)
+			it.Size = t.Size
+			it.hash = func() ([sha256.Size]byte, error) { return t.Hash, nil }
+		}
+		items[path] = it
+	}
+	return items, nil
+}
+
+// dirItems lists the directory like ArchiveDir does, files are hashed only when asked
+func dirItems(root, arpath string) (map[string]*diffItem, error) {
+	items := map[string]*diffItem{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 || path == arpath {
+			return nil
+		}
+		if flags.pattern != nil {
+			if b, err := flags.pattern.MatchString(strings.Replace(path, "\\", "/", -1)); !b || err != nil {
+				return nil
+			}
+		}
+
+		it := &diffItem{IsDir: info.IsDir(), Mode: info.Mode(), Size: info.Size(), Modtime: info.ModTime()}
+		it.hash = func() ([sha256.Size]byte, error) {
+			var sum [sha256.Size]byte
+			f, err := os.Open(path)
+			if err != nil {
+				return sum, err
+			}
+			defer f.Close()
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return sum, err
+			}
+			copy(sum[:], h.Sum(nil))
+			return sum, nil
+		}
+		if it.IsDir {
+			it.Size = 0
+		}
+		items[filepath.ToSlash(rel(root, path))] = it
+		return nil
+	})
+	return items, err
+}
+
+// compareItems returns the change from old to new, or "" if they are the same.
+// Contents are compared by size, then by hash if byHash, otherwise by modtime
+func compareItems(old, cur *diffItem, byHash bool) (string, error) {
+	if old.IsDir != cur.IsDir {
+		return "type", nil
+	}
+	if !old.IsDir {
+		if old.bad || cur.bad || old.Size != cur.Size {
+			return "modified", nil
+		}
+		if byHash {
+			h1, err := old.hash()
+			if err != nil {
+				return "", err
+			}
+			h2, err := cur.hash()
+			if err != nil {
+				return "", err
+			}
+			if h1 != h2 {
+				return "modified", nil
+			}
+		} else if old.coarse || cur.coarse {
+			if old.Modtime.Unix() != cur.Modtime.Unix() {
+				return "modified", nil
+			}
+		} else if !old.Modtime.Equal(cur.Modtime) {
+			return "modified", nil
+		}
+	}
+	if old.Mode.Perm() != cur.Mode.Perm() {
+		return "mode", nil
+	}
+	return "", nil
+}
+
+// Diff compares the archive with a directory or another archive, sorted by path.
+// Stored hashes are used for archives, files on the disk are hashed with -k,
+// two archives are always compared by hash
+func Diff(arpath, target, password string) ([]diffChange, error) {
+	a, err := arp.OpenArchive(arpath, password, false)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	old, err := archiveItems(a)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	var cur map[string]*diffItem
+	byHash := flags.checksum
+	if st.IsDir() {
+		cur, err = dirItems(target, arpath)
+	} else {
+		var b *arp.Archive
+		if b, err = arp.OpenArchive(target, password, false); err != nil {
+			return nil, err
+		}
+		defer b.Close()
+		cur, err = archiveItems(b)
+		byHash = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []diffChange{}
+	for path, o := range old {
+		n := cur[path]
+		if n == nil {
+			changes = append(changes, diffChange{Path: path, Change: "removed", Old: o.entry()})
+			continue
+		}
+		c, err := compareItems(o, n, byHash)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if c != "" {
+			changes = append(changes, diffChange{Path: path, Change: c, Old: o.entry(), New: n.entry()})
+		}
+	}
+	for path, n := range cur {
+		if old[path] == nil {
+			changes = append(changes, diffChange{Path: path, Change: "added", New: n.entry()})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// printDiff prints the changes, one per line or as JSON
+func printDiff(w io.Writer, changes []diffChange, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+
+	marks := map[string]string{"added": "+", "removed": "-", "modified": "M", "mode": "P", "type": "T"}
+	for _, c := range changes {
+		note := ""
+		switch c.Change {
+		case "modified":
+			note = fmt.Sprintf("  (%s -> %s)", humansize(c.Old.Size), humansize(c.New.Size))
+		case "mode":
+			note = fmt.Sprintf("  (%s -> %s)", c.Old.Mode, c.New.Mode)
+		case "type":
+			note = fmt.Sprintf("  (%s -> %s)", kindOf(c.Old), kindOf(c.New))
+		}
+		fmt.Fprintf(w, "%s %s%s\n", marks[c.Change], c.Path, note)
+	}
+	return nil
+}
+
+func kindOf(e *diffEntry) string {
+	if e.Dir {
+		return "dir"
+	}
+	return "file"
+}
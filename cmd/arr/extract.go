@@ -1,14 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"time"
+	"strconv"
 
 	"github.com/coyove/gowebp/arp"
 )
@@ -20,11 +17,11 @@ func Extract(arpath, destpath string, password string) {
 	var badFiles = 0
 	var o = newoneliner()
 
-	a, err := arp.OpenArchive(arpath, password, true)
+	a, err := arp.OpenArchive(arpath, password, false, trustedKeys()...)
 	fmtFatalErr(err)
 	defer a.Close()
 
-	fmtPrintln("Source:", arpath, "(", humansize(a.Info.Size()), "/", len(a.Cursor.Data), "files )")
+	fmtPrintln("Source:", arpath, "( v"+strconv.Itoa(a.Version), humansize(a.Info.Size()), "/", len(a.Cursor.Data), "files )")
 	if flags.action == 'l' {
 		if flags.checksum {
 			fmtPrintf("\nMode       Modtime                 Offset       Size  H\n\n")
@@ -35,41 +32,22 @@ func Extract(arpath, destpath string, password string) {
 		fmtPrintln("Output:", destpath)
 	}
 
-	pathbuf := make([]byte, 256)
-	count := uint32(len(a.Cursor.Data))
-
-	p := [arp.MetaSize]byte{}
-	for i := uint32(0); i < count; i++ {
-		_, err = a.Fd.Read(p[:2])
+	var transcoded map[string]*arp.TranscodeInfo
+	var origBytes, webpBytes int64
+	if flags.action == 'l' {
+		transcoded, err = a.TranscodeInfos()
 		fmtFatalErr(err)
+	}
 
-		pathlen := int(binary.BigEndian.Uint16(p[:2]))
-		if pathlen > len(pathbuf) {
-			pathbuf = make([]byte, pathlen)
-		}
-		if pathlen > 4096 {
-			fmtFatalErr(fmt.Errorf("unexpected long path: %d", pathlen))
+	count := uint32(len(a.Entries()))
+	for i, fi := range a.Entries() {
+		i := uint32(i)
+		// the transcode manifest is internal, it's shown as the notes of transcoded files instead
+		if fi.Path == arp.TranscodeManifest {
+			continue
 		}
-
-		_, err = a.Fd.Read(pathbuf[:4])
-		fmtFatalErr(err)
-		mode := os.FileMode(binary.BigEndian.Uint32(pathbuf))
-
-		_, err = a.Fd.Read(pathbuf[:4])
-		modtime := time.Unix(int64(binary.BigEndian.Uint32(pathbuf)), 0)
-		fmtFatalErr(err)
-
-		_, err = a.Fd.Read(pathbuf[:sha256.Size])
-		fmtFatalErr(err)
-
-		hash := [sha256.Size]byte{}
-		copy(hash[:], pathbuf[:sha256.Size])
-		isDir := bytes.Equal(pathbuf[:sha256.Size], []byte(arp.DirGUID))
-
-		_, err = a.Fd.Read(pathbuf[:pathlen])
-		fmtFatalErr(err)
-
-		path := string(a.DecodeBytes(pathbuf[:pathlen]))
+		path, isDir, modtime := fi.Path, fi.IsDir, fi.Modtime
+		mode := os.FileMode(fi.Mode)
 		finalpath := filepath.Join(destpath, path)
 
 		// list the content and continue reading
@@ -81,21 +59,26 @@ func Extract(arpath, destpath string, password string) {
 			}
 
 			modestr := uint32mod(uint32(mode))
+			note := ""
+			if fi.Codec != arp.CodecNone {
+				note = fmt.Sprintf("  [%s %s]", fi.Codec, humansize(fi.Size))
+			}
+			if t := transcoded[path]; t != nil {
+				note = fmt.Sprintf("  <- %s %s (%+.1f%%)", t.MIME, humansize(t.Size), (float64(length)/float64(t.Size)-1)*100)
+				origBytes += t.Size
+				webpBytes += int64(length)
+			}
 			if flags.checksum {
 				if !isDir {
-					old, err := a.Fd.Seek(0, 1)
-					fmtFatalErr(err)
 					if _, err = a.Stream(ioutil.Discard, path); err == arp.ErrCorruptedHash {
 						badFiles++
 						flag = " X "
 					}
-					_, err = a.Fd.Seek(old, 0)
-					fmtFatalErr(err)
 				}
 
-				fmtPrintf("%s %s %10x %10d %s %s\n", modestr, modtime.Format(tf), start, length, flag, shortenPath(path))
+				fmtPrintf("%s %s %10x %10d %s %s%s\n", modestr, modtime.Format(tf), start, length, flag, shortenPath(path), note)
 			} else {
-				fmtPrintf("%s %s %10x %10d %s\n", modestr, modtime.Format(tf), start, length, shortenPath(path))
+				fmtPrintf("%s %s %10x %10d %s%s\n", modestr, modtime.Format(tf), start, length, shortenPath(path), note)
 			}
 			continue
 		}
@@ -129,9 +112,6 @@ func Extract(arpath, destpath string, password string) {
 			continue
 		}
 
-		old, err := a.Fd.Seek(0, 1)
-		fmtFatalErr(err)
-
 		_, length, _ := a.Cursor.Get(path)
 		fmtPrintf("[%10s] %s", humansize(int64(length)), o.fill(path))
 
@@ -144,13 +124,15 @@ func Extract(arpath, destpath string, password string) {
 			continue
 		}
 		w.Close()
-
-		_, err = a.Fd.Seek(old, 0)
-		fmtFatalErr(err)
+		os.Chtimes(finalpath, fi.Atime, modtime)
 	}
 
 	if flags.action == 'l' {
 		fmtPrintln("\nTotal entries:", a.TotalEntries(), ", created at:", a.Created.Format(tf))
+		if len(transcoded) > 0 {
+			fmtPrintf("Transcoded: %d files, %s -> %s, saved %s\n", len(transcoded),
+				humansize(origBytes), humansize(webpBytes), humansize(origBytes-webpBytes))
+		}
 	} else {
 		fmtPrintln("\nFinished in", o.elapsed())
 	}
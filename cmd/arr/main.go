@@ -1,11 +1,12 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	_ "image/jpeg"
-	"io/ioutil"
+	_ "image/png"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -13,7 +14,6 @@ import (
 	"runtime"
 	"strings"
 	"time"
-	"unsafe"
 
 	"github.com/coyove/common/rand"
 	"github.com/coyove/gowebp/arp"
@@ -22,7 +22,7 @@ import (
 func main() {
 	parseFlags()
 
-	fmtPrintln("\nArr archive tool", runtime.GOOS, runtime.GOARCH, runtime.Version(), "\n")
+	fmtPrintf("\nArr archive tool %s %s %s\n\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
 
 	switch flags.action {
 	case 'a':
@@ -30,6 +30,39 @@ func main() {
 			arpath := filepath.Join(filepath.Dir(path), filepath.Base(path)+".arrpkg")
 			ArchiveDir(path, arpath, flags.password)
 		}
+	case 'u':
+		UpdateArchive(flags.paths[0], flags.paths[1], flags.password)
+	case 'd':
+		DeleteEntries(flags.paths[0], flags.glob, flags.password)
+	case 'c':
+		for _, path := range flags.paths {
+			CompactArchive(path, flags.password)
+		}
+	case 'r':
+		for _, path := range flags.paths {
+			RecoverArchive(path, flags.password)
+		}
+	case 's':
+		SignArchive(flags.paths[0], flags.paths[1], flags.password)
+	case 'V':
+		for _, path := range flags.paths {
+			VerifyArchive(path, flags.password)
+		}
+	case 'm':
+		MergeArchives(flags.output, flags.paths, flags.password)
+	case 'D':
+		// exit codes like diff(1): 0 for no differences, 1 for some, 2 for errors
+		changes, err := Diff(flags.paths[0], flags.paths[1], flags.password)
+		if err == nil {
+			err = printDiff(os.Stdout, changes, flags.json)
+		}
+		if err != nil {
+			fmtPrintferr("Error: %v\n", err)
+			os.Exit(2)
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
 	case 'l':
 		for _, path := range flags.paths {
 			Extract(path, "", flags.password)
@@ -43,69 +76,18 @@ func main() {
 			arp.DumpArchiveJmpTable(path, path+".jmp")
 		}
 	case 'w':
-		const tf = "2006-01-02 15:04:05"
-		a, err := arp.OpenArchive(flags.paths[0], flags.password, false)
+		a, err := arp.OpenArchive(flags.paths[0], flags.password, false, trustedKeys()...)
 		if err != nil {
 			fmtPrintferr("Error: %v\n", err)
 			os.Exit(1)
 		}
 
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			uri := r.URL.Path
-			if len(uri) == 0 {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			uri = uri[1:]
-			if strings.HasSuffix(uri, "/") {
-				uri = uri[:len(uri)-1]
-			}
-			if _, _, ok := a.GetFile(uri); ok {
-				a.Stream(w, uri)
-				return
-			}
-
-			w.Write([]byte(fmt.Sprintf(htmlHeader+`
-					<div>Total entries: %d, created at: %s</div>
-					<table border=1 style="border-collapse:collapse">
-					<tr><td> Mode </td><td> Modtime </td><td> Offset </td><td align=right> Size </td><td></td></tr>
-					<tr><td></td><td></td><td></td><td></td><td class=dir><a href="javascript:up()">..</a></td></tr>
-					`, flags.paths[0], a.TotalEntries(), a.Created.Format(tf))))
-
-			a.Iterate(func(info *arp.EntryInfo, start, l uint64) error {
-				if !isUnder(uri, info.Path) || info.Path == "." {
-					return nil
-				}
-
-				if info.IsDir {
-					w.Write([]byte(fmt.Sprintf(`<tr>
-							<td>%s</td>
-							<td>%s</td>
-							<td>Fdir</td>
-							<td align=right>-</td>
-							<td class=dir><a href='/%s'>%s</a></td>
-						</tr>`,
-						uint32mod(info.Mode),
-						info.Modtime.Format(tf), info.Path, filepath.Base(info.Path),
-					)))
-				} else {
-					w.Write([]byte(fmt.Sprintf(`<tr>
-						<td>%s</td>
-						<td>%s</td>
-						<td>0x%010x</td>
-						<td align=right>%d</td>
-						<td><a href='/%s'>%s</a></td>
-					</tr>`,
-						uint32mod(info.Mode),
-						info.Modtime.Format(tf), start, l, info.Path, filepath.Base(info.Path),
-					)))
-				}
-				return nil
-			})
-
-			w.Write([]byte("</table></html>"))
-		})
+		s, err := newWebServer(a)
+		if err != nil {
+			fmtPrintferr("Error: %v\n", err)
+			os.Exit(1)
+		}
+		http.Handle("/", s)
 
 		if flags.listen == "" {
 			listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -121,28 +103,76 @@ func main() {
 	}
 }
 
-// ArchiveDir archives the given directory into an archive
-// struct:
-// +---------------+----------+-------+------+-------+------+-- - -
-// | 24b metatable | jmptable | file1 | guid | file2 | guid | ...
-// +---------------+----------+-------+------+-------+------+-- - -
-// Currently there are only 3 fields in metatable:
-//    (4b) Magic code, current: zzz0
-// 1. (4b) Total files
-// 2. (4b) Archive created time
-// 3. (1b) Endianness, 1: Big endian, 0: Little endian
+// ArchiveDir archives the given directory into a v2 archive, see arp/format.go for the layout
 func ArchiveDir(dirpath, arpath string, password string) {
-	const dummy16 = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
-	pathbuflen, full := 0, make([]string, 0)
+	fmtPrintln("Archiving:", dirpath)
+	fmtPrintln("Output:   ", arpath)
+
+	ar, err := os.Create(arpath)
+	fmtFatalErr(err)
+	defer ar.Close()
+
+	aw, err := arp.NewWriter(ar, password)
+	fmtFatalErr(err)
+	archiveTo(aw, dirpath, arpath)
+}
+
+// UpdateArchive adds new and changed files of the given directory to an existing archive,
+// unchanged files are told by modtime and size, or by hash with -k
+func UpdateArchive(arpath, dirpath string, password string) {
+	fmtPrintln("Updating: ", arpath)
+	fmtPrintln("Source:   ", dirpath)
+
+	ar, err := os.OpenFile(arpath, os.O_RDWR, 0)
+	fmtFatalErr(err)
+	defer ar.Close()
+
+	aw, err := arp.NewAppendWriter(ar, password)
+	fmtFatalErr(err)
+	archiveTo(aw, dirpath, arpath)
+}
+
+// unchanged tells whether the file at path is archived as finalpath already,
+// images transcoded into webp are compared with their originals in the manifest
+func unchanged(aw *arp.Writer, manifest map[string]*arp.TranscodeInfo, path, finalpath string, st os.FileInfo) bool {
+	fi, ok := aw.Lookup(finalpath)
+	if t := manifest[finalpath+webpSuffix]; t != nil {
+		if webp, found := aw.Lookup(finalpath + webpSuffix); found {
+			fi, ok = &arp.EntryInfo{Path: webp.Path, Modtime: webp.Modtime, Size: t.Size, Hash: t.Hash}, true
+		}
+	}
+	if !ok || !flags.checksum {
+		return ok && fi.Unchanged(st)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	same, err := fi.SameContent(f)
+	return err == nil && same
+}
+
+// writeManifest writes the transcode manifest, replacing the old one if any
+func writeManifest(aw *arp.Writer, manifest map[string]*arp.TranscodeInfo) {
+	buf, err := json.Marshal(manifest)
+	fmtFatalErr(err)
+
+	now := time.Now()
+	fi := &arp.EntryInfo{Path: arp.TranscodeManifest, Mode: 0644, Modtime: now, Atime: now, Ctime: now}
+	_, err = aw.WriteFile(fi, bytes.NewReader(buf))
+	fmtFatalErr(err)
+}
+
+// archiveTo archives the given directory with aw, and closes it
+func archiveTo(aw *arp.Writer, dirpath, arpath string) {
+	full := make([]string, 0)
 	o := newoneliner()
 
 	var pathslist *os.File
 	var pathslistpath string
 	var totalFoundEntries int
-	const fileHdr = 2 + 4 + 4 + sha256.Size
-
-	fmtPrintln("Archiving:", dirpath)
-	fmtPrintln("Output:   ", arpath)
 
 	filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
 		path = strings.Replace(path, "\\", "/", -1)
@@ -190,38 +220,25 @@ func ArchiveDir(dirpath, arpath string, password string) {
 
 		path = rel(dirpath, path)
 		fmtPrintf("\r[%s] Search base: %s", o.elapsed(), o.fill(path))
-
-		pathbuflen += len(path) + fileHdr
-		// info.Mode(): uint32
-		// info.ModTime(): uint32
 		return nil
 	})
 
 	fmtPrintf("\r[%s] Search base: found %d files, start archiving...\n", o.elapsed(), totalFoundEntries)
 
-	ar, err := os.Create(arpath)
-	fmtFatalErr(err)
-
-	defer ar.Close()
-
-	p, count := [arp.MetaSize]byte{'z', 'z', 'z', '0'}, totalFoundEntries
-
-	binary.BigEndian.PutUint32(p[4:8], uint32(count))
-	binary.BigEndian.PutUint32(p[8:12], uint32(time.Now().Unix()))
-	p[12] = *(*byte)(unsafe.Pointer(&arp.One))
-
-	_, err = ar.Write(p[:])
-	fmtFatalErr(err)
+	if flags.codec != arp.CodecNone {
+		aw.Policy = arp.DefaultCodecPolicy(flags.codec)
+	}
 
-	headerlen := (arp.MetaSize*count + pathbuflen + 15) / 16 * 16
-	// log.Println(headerlen, count, pathbuflen)
-	for i := 0; i < headerlen/16; i++ {
-		_, err := ar.WriteString(dummy16)
+	manifest := map[string]*arp.TranscodeInfo{}
+	if base := aw.Base(); base != nil {
+		m, err := base.TranscodeInfos()
 		fmtFatalErr(err)
+		for k, v := range m {
+			manifest[k] = v
+		}
 	}
-
-	cursor, pcursor := int64(headerlen+arp.MetaSize), int64(count)*arp.MetaSize+arp.MetaSize
-	m := arp.Uint64OneTwoMap{}
+	var savedBytes int64
+	var transcodedFiles, skippedFiles int
 	iteratePaths(full, pathslist, func(i int, path string) {
 		finalpath := rel(dirpath, path)
 		finalpath = strings.Replace(finalpath, "\\", "/", -1)
@@ -235,7 +252,14 @@ func ArchiveDir(dirpath, arpath string, password string) {
 			fmtMaybeErr(path, err)
 			// if users chose to ignore errors, we will still insert the entry into jmptable
 			// but with arp.ErrFlag.
-			m.Push(finalpath, arp.ErrFlag, arp.ErrFlag)
+			if err := aw.WriteError(&arp.EntryInfo{Path: finalpath}); err != nil {
+				fmtMaybeErr(finalpath, err)
+			}
+			return
+		}
+		if aw.Base() != nil && !st.IsDir() && unchanged(aw, manifest, path, finalpath, st) {
+			fmtPrintf("\r[%s] [%02d%%] [%10s] %s", o.elapsed(), (i * 100 / totalFoundEntries), "unchanged", o.fill(finalpath))
+			skippedFiles++
 			return
 		}
 		if !st.IsDir() {
@@ -243,10 +267,26 @@ func ArchiveDir(dirpath, arpath string, password string) {
 		}
 		if err != nil {
 			fmtMaybeErr(path, err)
-			m.Push(finalpath, arp.ErrFlag, arp.ErrFlag)
+			if err := aw.WriteError(arp.NewEntryInfo(finalpath, st)); err != nil {
+				fmtMaybeErr(finalpath, err)
+			}
 			return
 		}
 
+		var transcoded []byte
+		var tinfo *arp.TranscodeInfo
+		if file != nil && len(flags.transcode) > 0 {
+			if r := matchTranscodeRule(finalpath); r != nil {
+				transcoded, tinfo, err = transcodeImage(path, r)
+				if err != nil {
+					// the original file will be archived if users chose to ignore errors
+					fmtMaybeErr(path, err)
+				} else if transcoded != nil {
+					finalpath += webpSuffix
+				}
+			}
+		}
+
 		fmtPrintf("\r[%s] [%02d%%] ", o.elapsed(), (i * 100 / totalFoundEntries))
 
 		if st.IsDir() {
@@ -255,69 +295,52 @@ func ArchiveDir(dirpath, arpath string, password string) {
 			fmtPrintf("[%10s] %s", humansize(st.Size()), o.fill(finalpath))
 		}
 
-		binary.BigEndian.PutUint16(p[:2], uint16(len(finalpath)))
-		binary.BigEndian.PutUint32(p[2:6], uint32(st.Mode()))
-		binary.BigEndian.PutUint32(p[6:10], uint32(st.ModTime().Unix()))
-
-		_, err = ar.WriteAt(p[:10], pcursor)
-		fmtFatalErr(err)
-		pcursor += 10
-
+		fi := arp.NewEntryInfo(finalpath, st)
 		if st.IsDir() {
 			// for directories, they have no real contents
-			// so we will use arp.DirFlag as hash to identify
-			_, err = ar.WriteAt([]byte(arp.DirGUID), pcursor)
-			fmtFatalErr(err)
-			pcursor += sha256.Size
-
-			finalfinalpath, _ := ioutil.ReadAll(arp.WrapReaderWriter(strings.NewReader(finalpath), nil, password))
-			_, err = ar.WriteAt(finalfinalpath, pcursor)
-			fmtFatalErr(err)
-
-			pcursor += int64(len(finalpath))
-			m.Push(finalpath, arp.DirFlag, arp.DirFlag)
+			if err := aw.WriteDir(fi); err != nil {
+				fmtMaybeErr(finalpath, err)
+			}
 			return
 		}
 
-		// append the file content to the end of the archive
-		beforeAppend, err := ar.Seek(0, 1)
-		fmtFatalErr(err)
+		var src io.Reader = file
+		if transcoded != nil {
+			src = bytes.NewReader(transcoded)
+		}
 
-		n, h, err := arp.HashCopy(ar, arp.WrapReaderWriter(file, nil, password))
+		n, err := aw.WriteFile(fi, src)
+		file.Close()
 		if err != nil {
 			fmtMaybeErr(path, err)
-			m.Push(finalpath, arp.ErrFlag, arp.ErrFlag)
-			pcursor -= 10
-			_, err = ar.Seek(beforeAppend, 0)
-			fmtFatalErr(err)
+			if err != arp.ErrDuplicatePath {
+				if err := aw.WriteError(fi); err != nil {
+					fmtMaybeErr(finalpath, err)
+				}
+			}
 			return
 		}
 
-		// write hash at pcursor
-		_, err = ar.WriteAt(h, pcursor)
-		fmtFatalErr(err)
-
-		pcursor += sha256.Size
-		finalfinalpath, _ := ioutil.ReadAll(arp.WrapReaderWriter(strings.NewReader(finalpath), nil, password))
-		_, err = ar.WriteAt(finalfinalpath, pcursor)
-		fmtFatalErr(err)
-
-		pcursor += int64(len(finalpath))
-		m.Push(finalpath, uint64(cursor), uint64(n))
-
-		cursor += n
-		if err := file.Close(); err != nil {
-			fmtMaybeErr(path, err)
-			return
+		if transcoded != nil {
+			manifest[finalpath] = tinfo
+			savedBytes += tinfo.Size - n
+			transcodedFiles++
 		}
 
-		if flags.deloriginal && flags.delimm && !st.IsDir() {
+		if flags.deloriginal && flags.delimm {
 			os.Remove(full[i])
 		}
 	})
 
-	m.Seal()
-	ar.WriteAt(m.Bytes(), arp.MetaSize)
+	if len(flags.transcode) > 0 || len(manifest) > 0 {
+		writeManifest(aw, manifest)
+		fmtPrintf("\nTranscoded %d files into webp, saved %s\n", transcodedFiles, humansize(savedBytes))
+	}
+
+	fmtFatalErr(aw.Close())
+	if n := aw.Collisions(); n > 0 {
+		fmtPrintferr("\n%d paths have colliding hashes, lookups of them are slightly slower\n", n)
+	}
 
 	if flags.deloriginal {
 		for _, p := range full {
@@ -330,6 +353,10 @@ func ArchiveDir(dirpath, arpath string, password string) {
 		os.Remove(pathslistpath)
 	}
 
+	if aw.Base() != nil {
+		fmtPrintf("\nUpdated %d files, %d unchanged\n", totalFoundEntries-skippedFiles, skippedFiles)
+	}
+
 	st, _ := os.Stat(arpath)
 	size := st.Size()
 	fmtPrintln("\nFinished in", o.elapsed(), ", size:", size, "bytes /", humansize(size))
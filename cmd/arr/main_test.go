@@ -2,13 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/coyove/gowebp"
 	"github.com/coyove/gowebp/arp"
 
 	"github.com/coyove/common/rand"
@@ -61,8 +76,8 @@ func TestMainFuzzy(t *testing.T) {
 	os.Mkdir(src, 0777)
 	generateRandomDirectory(src)
 
-	ArchiveDir(src, src+".arrpkg")
-	ar, err := arp.OpenArchive(src+".arrpkg", false)
+	ArchiveDir(src, src+".arrpkg", "")
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -101,3 +116,704 @@ func TestMainFuzzy(t *testing.T) {
 	os.Remove(src + ".arrpkg")
 	os.RemoveAll(src)
 }
+
+func TestTranscode(t *testing.T) {
+	const src = "=test2"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i / 4 % 128)
+	}
+	pngbuf := &bytes.Buffer{}
+	png.Encode(pngbuf, img)
+	ioutil.WriteFile(src+"/a.png", pngbuf.Bytes(), 0644)
+	ioutil.WriteFile(src+"/b.txt", []byte("not an image"), 0644)
+	ioutil.WriteFile(src+"/c.jpg", []byte("not a jpeg either"), 0644)
+
+	flags.transcode = parseTranscodeRules("80")
+	defer func() { flags.transcode = nil }()
+
+	ArchiveDir(src, src+".arrpkg", "")
+	defer os.Remove(src + ".arrpkg")
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	for _, path := range []string{"a.png.webp", "b.txt", "c.jpg", arp.TranscodeManifest} {
+		if !ar.Contains(path) {
+			t.Fatal(path, "not found")
+		}
+	}
+
+	infos, err := ar.TranscodeInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatal("unexpected manifest:", infos)
+	}
+
+	info := infos["a.png.webp"]
+	if info == nil || info.MIME != "image/png" || info.Size != int64(pngbuf.Len()) || info.Hash != sha256.Sum256(pngbuf.Bytes()) {
+		t.Fatal("unexpected transcode info:", info)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := ar.Stream(buf, "a.png.webp"); err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) >= info.Size {
+		t.Fatal("webp is not smaller")
+	}
+
+	webp, err := gowebp.DecodeWithOptions(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webp.Bounds() != img.Bounds() {
+		t.Fatal("size not matched")
+	}
+
+	// the manifest stays in the archive
+	dest := src + "/out"
+	Extract(src+".arrpkg", dest, "")
+	if _, err := os.Stat(dest + "/a.png.webp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest + "/" + arp.TranscodeManifest); !os.IsNotExist(err) {
+		t.Fatal("manifest extracted:", err)
+	}
+}
+
+func TestTranscodeOrientation(t *testing.T) {
+	const src = "=test15"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+
+	// a 64x32 photo taken with the camera rotated, orientation 6 displays it rotated 90 degrees clockwise
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	jpgbuf := &bytes.Buffer{}
+	jpeg.Encode(jpgbuf, img, &jpeg.Options{Quality: 100})
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	app1 := append([]byte{0xff, 0xe1, 0, byte(2 + 6 + len(tiff))}, "Exif\x00\x00"...)
+	photo := append(append(append([]byte{}, jpgbuf.Bytes()[:2]...), append(app1, tiff...)...), jpgbuf.Bytes()[2:]...)
+	ioutil.WriteFile(src+"/a.jpg", photo, 0644)
+
+	if o := gowebp.ExifOrientation(jpegExif(photo)); o != 6 {
+		t.Fatal("unexpected orientation:", o)
+	}
+
+	flags.transcode = parseTranscodeRules("100")
+	defer func() { flags.transcode = nil }()
+	ArchiveDir(src, src+".arrpkg", "")
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	buf, err := ar.ReadFile("a.jpg.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webp, err := gowebp.DecodeWithOptions(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webp.Bounds().Dx() != 32 || webp.Bounds().Dy() != 64 {
+		t.Fatal("not rotated:", webp.Bounds())
+	}
+	if o := gowebp.ExifOrientation(gowebp.ReadChunk(buf, "EXIF")); o != 1 {
+		t.Fatal("unexpected orientation:", o)
+	}
+}
+
+func TestWebGallery(t *testing.T) {
+	const src = "=test3"
+	os.RemoveAll(src)
+	os.MkdirAll(src+"/sub", 0777)
+	defer os.RemoveAll(src)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	pngbuf, webpbuf := &bytes.Buffer{}, &bytes.Buffer{}
+	png.Encode(pngbuf, img)
+	gowebp.Encode(webpbuf, img, gowebp.DefaultEncoderOptions(80))
+	ioutil.WriteFile(src+"/sub/a.png", pngbuf.Bytes(), 0644)
+	ioutil.WriteFile(src+"/sub/b.webp", webpbuf.Bytes(), 0644)
+	ioutil.WriteFile(src+"/sub/c.txt", []byte("text"), 0644)
+
+	ArchiveDir(src, src+".arrpkg", "")
+	defer os.Remove(src + ".arrpkg")
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	flags.paths = []string{src + ".arrpkg"}
+	s, err := newWebServer(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", uri, nil)
+		r.Header.Set("Accept", "image/webp,*/*")
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal(uri, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	if body := get("/sub").Body.String(); !strings.Contains(body, "(2 images)") {
+		t.Fatal("no gallery link:", body)
+	}
+
+	body := get("/sub?gallery").Body.String()
+	for _, p := range []string{"/sub/a.png?thumb", "/sub/b.webp?view"} {
+		if !strings.Contains(body, p) {
+			t.Fatal(p, "not in gallery")
+		}
+	}
+	if strings.Contains(body, "c.txt") {
+		t.Fatal("non-image in gallery")
+	}
+
+	for _, p := range []string{"/sub/a.png?thumb", "/sub/b.webp?thumb"} {
+		w := get(p)
+		if ct := w.Header().Get("Content-Type"); ct != "image/webp" {
+			t.Fatal(p, "content type:", ct)
+		}
+		thumb, err := gowebp.DecodeWithOptions(w.Body.Bytes(), nil)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		if b := thumb.Bounds(); b.Dx() != 200 || b.Dy() != 150 {
+			t.Fatal(p, "thumbnail size:", b)
+		}
+	}
+	if len(s.thumbs) != 2 {
+		t.Fatal("thumbnails not cached")
+	}
+
+	body = get("/sub/b.webp?view").Body.String()
+	for _, p := range []string{"400 x 300", "webp, lossy", "/sub/a.png?view"} {
+		if !strings.Contains(body, p) {
+			t.Fatal(p, "not in lightbox:", body)
+		}
+	}
+}
+
+func TestWebNegotiate(t *testing.T) {
+	const src = "=test4"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	opaque, alpha := &bytes.Buffer{}, &bytes.Buffer{}
+	gowebp.Encode(alpha, img, gowebp.DefaultEncoderOptions(80))
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	gowebp.Encode(opaque, img, gowebp.DefaultEncoderOptions(80))
+	ioutil.WriteFile(src+"/opaque.webp", opaque.Bytes(), 0644)
+	ioutil.WriteFile(src+"/alpha.webp", alpha.Bytes(), 0644)
+	ioutil.WriteFile(src+"/c.txt", []byte("text"), 0644)
+
+	ArchiveDir(src, src+".arrpkg", "")
+	defer os.Remove(src + ".arrpkg")
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	s, err := newWebServer(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		uri, accept, ct string
+		vary            bool
+	}{
+		{"/opaque.webp", "image/webp,image/*,*/*;q=0.8", "image/webp", true},
+		{"/opaque.webp", "image/png,image/*;q=0.8,*/*;q=0.5", "image/jpeg", true},
+		{"/opaque.webp", "image/webp;q=0,*/*", "image/jpeg", true},
+		{"/opaque.webp", "", "image/jpeg", true},
+		{"/alpha.webp", "*/*", "image/png", true},
+		{"/alpha.webp", "IMAGE/WEBP", "image/webp", true},
+		{"/opaque.webp?thumb", "*/*", "image/jpeg", true},
+		{"/c.txt", "", "text/plain; charset=utf-8", false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.uri, nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		s.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatal(c.uri, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.ct {
+			t.Errorf("%s with %q: got %s, want %s", c.uri, c.accept, ct, c.ct)
+		}
+		if vary := w.Header().Get("Vary") == "Accept"; vary != c.vary {
+			t.Errorf("%s: unexpected Vary header %q", c.uri, w.Header().Get("Vary"))
+		}
+
+		var err error
+		switch c.ct {
+		case "image/jpeg":
+			_, err = jpeg.Decode(w.Body)
+		case "image/png":
+			var m image.Image
+			if m, err = png.Decode(w.Body); err == nil && m.(*image.NRGBA).Pix[3] == 0xff {
+				t.Errorf("%s: alpha is lost", c.uri)
+			}
+		case "image/webp":
+			if !bytes.Equal(w.Body.Bytes(), opaque.Bytes()) && !bytes.Equal(w.Body.Bytes(), alpha.Bytes()) {
+				t.Errorf("%s: webp is modified", c.uri)
+			}
+		}
+		if err != nil {
+			t.Error(c.uri, err)
+		}
+	}
+}
+
+func TestArchiveFS(t *testing.T) {
+	const src = "=test6"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+	generateRandomDirectory(src)
+	os.MkdirAll(src+"/empty", 0777)
+
+	var files []string
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			files = append(files, filepath.ToSlash(rel(src, path)))
+		}
+		return nil
+	})
+
+	defer func() { flags.codec = arp.CodecNone }()
+	for _, c := range []struct {
+		codec    arp.Codec
+		password string
+	}{{arp.CodecNone, ""}, {arp.CodecDeflate, ""}, {arp.CodecGzip, "secret"}} {
+		flags.codec = c.codec
+		ArchiveDir(src, src+".arrpkg", c.password)
+
+		ar, err := arp.OpenArchive(src+".arrpkg", c.password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fstest.TestFS(ar, files...); err != nil {
+			t.Fatal(c.codec, c.password, err)
+		}
+
+		f, err := ar.Open(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.(interface {
+			io.ReaderAt
+			io.Seeker
+		}); !ok {
+			t.Fatal("file should implement io.ReaderAt and io.Seeker")
+		}
+		f.Close()
+
+		if fi, err := fs.Stat(ar, "empty"); err != nil || !fi.IsDir() {
+			t.Fatal("empty directory not found:", err)
+		}
+		ar.Close()
+	}
+	os.Remove(src + ".arrpkg")
+}
+
+func TestWebRange(t *testing.T) {
+	const src = "=test7"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	ioutil.WriteFile(src+"/a.txt", content, 0644)
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(src+"/a.txt", mod, mod)
+
+	flags.codec = arp.CodecDeflate
+	defer func() { flags.codec = arp.CodecNone }()
+	ArchiveDir(src, src+".arrpkg", "")
+	defer os.Remove(src + ".arrpkg")
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	s, err := newWebServer(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get()
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(content))
+	h := w.Header()
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatal("unexpected response:", w.Code)
+	}
+	if h.Get("ETag") != etag || h.Get("Accept-Ranges") != "bytes" || h.Get("Content-Length") != "1000" ||
+		h.Get("Last-Modified") != mod.Format(http.TimeFormat) || h.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal("unexpected headers:", h)
+	}
+
+	w = get("Range", "bytes=12-15")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 12-15/1000" {
+		t.Fatal("unexpected range:", w.Code, w.Body.String(), w.Header())
+	}
+
+	w = get("Range", "bytes=0-1,998-")
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(w.Body.String(), "\r\n\r\n01\r\n") || !strings.Contains(w.Body.String(), "\r\n\r\n89\r\n") {
+		t.Fatal("unexpected multi-range:", w.Code, w.Body.String())
+	}
+
+	for _, header := range [][]string{
+		{"If-None-Match", etag},
+		{"If-None-Match", `W/"x", ` + etag},
+		{"If-Modified-Since", mod.Format(http.TimeFormat)},
+	} {
+		if w = get(header...); w.Code != http.StatusNotModified {
+			t.Fatal(header, "expect 304, got:", w.Code)
+		}
+	}
+	if w = get("If-None-Match", `"other"`); w.Code != http.StatusOK {
+		t.Fatal("expect 200, got:", w.Code)
+	}
+	if w = get("Range", "bytes=0-1", "If-Range", `"other"`); w.Code != http.StatusOK {
+		t.Fatal("expect the full content on a changed If-Range, got:", w.Code)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	const src = "=test8"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range map[string]string{"a.txt": "hello", "b.txt": "world!", "c.txt": "same"} {
+		ioutil.WriteFile(src+"/"+name, []byte(content), 0644)
+		os.Chtimes(src+"/"+name, mod, mod)
+	}
+	ArchiveDir(src, src+".arrpkg", "secret")
+
+	positions := func() map[string]uint64 {
+		ar, err := arp.OpenArchive(src+".arrpkg", "secret", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ar.Close()
+		res := map[string]uint64{}
+		for _, fi := range ar.Entries() {
+			res[fi.Path], _, _ = ar.GetFile(fi.Path)
+		}
+		return res
+	}
+	old := positions()
+
+	ioutil.WriteFile(src+"/a.txt", []byte("hello again"), 0644)
+	ioutil.WriteFile(src+"/d.txt", []byte("new"), 0644)
+	os.Chtimes(src+"/c.txt", mod.Add(time.Hour), mod.Add(time.Hour))
+
+	flags.checksum = true
+	defer func() { flags.checksum = false }()
+	UpdateArchive(src+".arrpkg", src, "secret")
+
+	now := positions()
+	if now["a.txt"] == old["a.txt"] || now["d.txt"] == 0 {
+		t.Fatal("changed files not updated:", old, now)
+	}
+	if now["b.txt"] != old["b.txt"] || now["c.txt"] != old["c.txt"] {
+		t.Fatal("unchanged files rewritten:", old, now)
+	}
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	for name, content := range map[string]string{"a.txt": "hello again", "b.txt": "world!", "c.txt": "same", "d.txt": "new"} {
+		buf, err := ar.ReadFile(name)
+		if err != nil || string(buf) != content {
+			t.Fatal(name, "content not matched:", string(buf), err)
+		}
+	}
+}
+
+func TestDeleteCompact(t *testing.T) {
+	const src = "=test9"
+	os.RemoveAll(src)
+	os.MkdirAll(src+"/sub", 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+
+	for name, content := range map[string]string{"a.txt": "hello", "b.log": "secret", "sub/c.txt": "world!", "sub/d.txt": "!"} {
+		ioutil.WriteFile(src+"/"+name, []byte(content), 0644)
+	}
+	ArchiveDir(src, src+".arrpkg", "")
+
+	DeleteEntries(src+".arrpkg", "*.log", "")
+	DeleteEntries(src+".arrpkg", "sub", "")
+	before, _ := os.Stat(src + ".arrpkg")
+	CompactArchive(src+".arrpkg", "")
+	after, _ := os.Stat(src + ".arrpkg")
+	if after.Size() >= before.Size() {
+		t.Fatal("nothing reclaimed:", before.Size(), after.Size())
+	}
+
+	ar, err := arp.OpenArchive(src+".arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	var paths []string
+	for _, fi := range ar.Entries() {
+		paths = append(paths, fi.Path)
+	}
+	if strings.Join(paths, ",") != ".,a.txt" {
+		t.Fatal("unexpected entries:", paths)
+	}
+	if buf, err := ar.ReadFile("a.txt"); err != nil || string(buf) != "hello" {
+		t.Fatal("unexpected content:", string(buf), err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const src1, src2 = "=test10", "=test11"
+	for _, src := range []string{src1, src2} {
+		os.RemoveAll(src)
+		os.Mkdir(src, 0777)
+		defer os.RemoveAll(src)
+		defer os.Remove(src + ".arrpkg")
+	}
+	defer os.Remove("=merged.arrpkg")
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	pngbuf := &bytes.Buffer{}
+	png.Encode(pngbuf, img)
+	ioutil.WriteFile(src1+"/a.png", pngbuf.Bytes(), 0644)
+	ioutil.WriteFile(src1+"/b.txt", []byte("first"), 0644)
+	ioutil.WriteFile(src2+"/b.txt", []byte("second"), 0644)
+
+	flags.transcode = parseTranscodeRules("80")
+	ArchiveDir(src1, src1+".arrpkg", "")
+	flags.transcode = nil
+	ArchiveDir(src2, src2+".arrpkg", "")
+
+	flags.prefixes = map[int]string{0: "2019"}
+	flags.conflict = arp.RenameConflict
+	defer func() { flags.prefixes, flags.conflict = nil, arp.KeepNewest }()
+	MergeArchives("=merged.arrpkg", []string{src1 + ".arrpkg", src2 + ".arrpkg", src2 + ".arrpkg"}, "")
+
+	ar, err := arp.OpenArchive("=merged.arrpkg", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+
+	for path, content := range map[string]string{"2019/b.txt": "first", "b.txt": "second", "b (2).txt": "second"} {
+		if buf, err := ar.ReadFile(path); err != nil || string(buf) != content {
+			t.Fatal(path, "content not matched:", string(buf), err)
+		}
+	}
+	infos, err := ar.TranscodeInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := infos["2019/a.png.webp"]; len(infos) != 1 || info == nil || info.Size != int64(pngbuf.Len()) {
+		t.Fatal("unexpected manifest:", infos)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	const src = "=test12"
+	os.RemoveAll(src)
+	os.MkdirAll(src+"/sub", 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+	defer os.Remove(src + "-2.arrpkg")
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	pngbuf := &bytes.Buffer{}
+	png.Encode(pngbuf, img)
+	ioutil.WriteFile(src+"/a.png", pngbuf.Bytes(), 0644)
+	for name, content := range map[string]string{"b.txt": "hello", "c.txt": "world", "d.txt": "same", "e.txt": "x", "sub/f.txt": "gone"} {
+		ioutil.WriteFile(src+"/"+name, []byte(content), 0644)
+	}
+	flags.transcode = parseTranscodeRules("80")
+	ArchiveDir(src, src+".arrpkg", "")
+	flags.transcode = nil
+
+	changes, err := Diff(src+".arrpkg", src, "")
+	if err != nil || len(changes) != 0 {
+		t.Fatal("unexpected changes:", changes, err)
+	}
+
+	ioutil.WriteFile(src+"/b.txt", []byte("hello!"), 0644)
+	ioutil.WriteFile(src+"/d.txt", []byte("same"), 0644) // touched only
+	os.Chtimes(src+"/d.txt", time.Now(), time.Now().Add(time.Hour))
+	os.Chmod(src+"/e.txt", 0600)
+	os.Remove(src + "/c.txt")
+	os.Mkdir(src+"/c.txt", 0755)
+	os.RemoveAll(src + "/sub")
+	ioutil.WriteFile(src+"/g.txt", []byte("new"), 0644)
+
+	summary := func(changes []diffChange) string {
+		var s []string
+		for _, c := range changes {
+			s = append(s, c.Path+":"+c.Change)
+		}
+		return strings.Join(s, ",")
+	}
+
+	const expected = "b.txt:modified,c.txt:type,%se.txt:mode,g.txt:added,sub:removed,sub/f.txt:removed"
+	changes, err = Diff(src+".arrpkg", src, "")
+	if s := summary(changes); err != nil || s != fmt.Sprintf(expected, "d.txt:modified,") {
+		t.Fatal("unexpected changes:", s, err)
+	}
+
+	flags.checksum = true
+	defer func() { flags.checksum = false }()
+	changes, err = Diff(src+".arrpkg", src, "")
+	if s := summary(changes); err != nil || s != fmt.Sprintf(expected, "") {
+		t.Fatal("unexpected changes:", s, err)
+	}
+
+	// archives are compared by hash, the modtimes of the new archive differ
+	flags.transcode = parseTranscodeRules("80")
+	ArchiveDir(src, src+"-2.arrpkg", "")
+	flags.transcode = nil
+	flags.checksum = false
+	changes, err = Diff(src+".arrpkg", src+"-2.arrpkg", "")
+	if s := summary(changes); err != nil || s != fmt.Sprintf(expected, "") {
+		t.Fatal("unexpected changes:", s, err)
+	}
+
+	buf := &bytes.Buffer{}
+	printDiff(buf, changes, false)
+	if !strings.Contains(buf.String(), "T c.txt  (file -> dir)\n") || !strings.Contains(buf.String(), "+ g.txt\n") {
+		t.Fatal("unexpected output:", buf.String())
+	}
+
+	buf.Reset()
+	printDiff(buf, changes, true)
+	var decoded []diffChange
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || summary(decoded) != summary(changes) {
+		t.Fatal("unexpected json:", buf.String(), err)
+	}
+	if decoded[0].Old.Size != 5 || decoded[0].New.Size != 6 {
+		t.Fatal("unexpected sizes:", decoded[0].Old, decoded[0].New)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	const src = "=test13"
+	os.RemoveAll(src)
+	os.MkdirAll(src+"/sub", 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+	defer os.Remove(src + ".recovered.arrpkg")
+
+	for name, content := range map[string]string{"a.txt": "hello", "sub/b.txt": "world!"} {
+		ioutil.WriteFile(src+"/"+name, []byte(content), 0644)
+	}
+	ArchiveDir(src, src+".arrpkg", "")
+
+	f, _ := os.OpenFile(src+".arrpkg", os.O_RDWR, 0)
+	f.WriteAt(make([]byte, 16), 0)
+	f.Close()
+	if _, err := arp.OpenArchive(src+".arrpkg", "", false); err == nil {
+		t.Fatal("damaged archive opened")
+	}
+
+	RecoverArchive(src+".arrpkg", "")
+	changes, err := Diff(src+".recovered.arrpkg", src, "")
+	if err != nil || len(changes) != 0 {
+		t.Fatal("unexpected changes:", changes, err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	const src = "=test14"
+	os.RemoveAll(src)
+	os.Mkdir(src, 0777)
+	defer os.RemoveAll(src)
+	defer os.Remove(src + ".arrpkg")
+	defer os.Remove(src + ".key")
+	defer os.Remove(src + ".pub")
+
+	pub, key, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(src+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	ioutil.WriteFile(src+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	ioutil.WriteFile(src+"/a.txt", []byte("hello"), 0644)
+	ArchiveDir(src, src+".arrpkg", "")
+	SignArchive(src+".arrpkg", src+".key", "")
+
+	flags.pubkey = src + ".pub"
+	defer func() { flags.pubkey = "" }()
+	VerifyArchive(src+".arrpkg", "")
+
+	loaded := trustedKeys()
+	if len(loaded) != 1 || !bytes.Equal(loaded[0], pub) {
+		t.Fatal("unexpected public key:", loaded)
+	}
+	if _, err := loadPublicKey(src + ".key"); err == nil {
+		t.Fatal("private key loaded as a public key")
+	}
+	if _, err := arp.OpenArchive(src+".arrpkg", "", false, loaded...); err != nil {
+		t.Fatal(err)
+	}
+}
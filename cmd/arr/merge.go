@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coyove/gowebp/arp"
+)
+
+// MergeArchives merges the archives into output, entries of an archive are put under its
+// prefix in flags.prefixes, conflicts are resolved by flags.conflict
+func MergeArchives(output string, paths []string, password string) {
+	o := newoneliner()
+	fmtPrintln("Output:", output)
+
+	sources := make([]arp.MergeSource, len(paths))
+	for i, path := range paths {
+		if path == output {
+			fmtFatalErr(fmt.Errorf("can't merge %s into itself", path))
+		}
+		a, err := arp.OpenArchive(path, password, false)
+		fmtFatalErr(err)
+		defer a.Close()
+
+		sources[i] = arp.MergeSource{Archive: a, Prefix: flags.prefixes[i]}
+		fmtPrintln("Source:", path, "(", a.TotalEntries(), "files ) ->", "/"+sources[i].Prefix)
+	}
+
+	f, err := os.Create(output)
+	fmtFatalErr(err)
+	defer f.Close()
+
+	// sharing the keys with the first archive, its contents can be copied as is
+	aw, err := arp.NewWriterFrom(f, sources[0].Archive)
+	fmtFatalErr(err)
+	if flags.codec != arp.CodecNone {
+		aw.Policy = arp.DefaultCodecPolicy(flags.codec)
+	}
+
+	fmtFatalErr(arp.Merge(aw, sources, flags.conflict))
+	fmtFatalErr(aw.Close())
+
+	st, _ := os.Stat(output)
+	size := st.Size()
+	fmtPrintln("Finished in", o.elapsed(), ", size:", size, "bytes /", humansize(size))
+}
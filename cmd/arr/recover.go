@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/coyove/gowebp/arp"
+)
+
+// RecoverArchive rebuilds the damaged archive into <name>.recovered.arrpkg next to it,
+// every file is verified by its hash, it exits with 1 if any of them is lost
+func RecoverArchive(arpath, password string) {
+	o := newoneliner()
+	output := strings.TrimSuffix(arpath, ".arrpkg") + ".recovered.arrpkg"
+	fmtPrintln("Recovering:", arpath)
+	fmtPrintln("Output:    ", output)
+
+	f, err := os.Create(output)
+	fmtFatalErr(err)
+	defer f.Close()
+
+	n, lost, err := arp.Recover(f, arpath, password)
+	if err != nil {
+		f.Close()
+		os.Remove(output)
+		fmtFatalErr(err)
+	}
+	for _, p := range lost {
+		fmtPrintferr("Lost: %s\n", p)
+	}
+	fmtPrintf("\nRecovered %d files, %d lost in %s\n", n, len(lost), o.elapsed())
+	if len(lost) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/coyove/gowebp/arp"
+)
+
+// loadPEM reads the first PEM block of the file
+func loadPEM(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return blk.Bytes, nil
+}
+
+// loadPrivateKey reads an ed25519 private key in PKCS #8 PEM, like the output of
+// 'openssl genpkey -algorithm ed25519'
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := loadPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := k.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+}
+
+// loadPublicKey reads an ed25519 public key in PKIX PEM, like the output of 'openssl pkey -pubout'
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := loadPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := k.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 public key", path)
+}
+
+// trustedKeys returns the key given by --pubkey, archives must be signed by it to be opened
+func trustedKeys() []ed25519.PublicKey {
+	if flags.pubkey == "" {
+		return nil
+	}
+	pub, err := loadPublicKey(flags.pubkey)
+	fmtFatalErr(err)
+	return []ed25519.PublicKey{pub}
+}
+
+// SignArchive signs the archive with the private key in keypath, the signature covers
+// the root hash of the archive, a new index is appended along with it
+func SignArchive(arpath, keypath, password string) {
+	key, err := loadPrivateKey(keypath)
+	fmtFatalErr(err)
+
+	f, err := os.OpenFile(arpath, os.O_RDWR, 0)
+	fmtFatalErr(err)
+	defer f.Close()
+
+	aw, err := arp.NewAppendWriter(f, password)
+	fmtFatalErr(err)
+	aw.Sign(key)
+	fmtFatalErr(aw.Close())
+
+	a, err := arp.OpenArchive(arpath, password, false, key.Public().(ed25519.PublicKey))
+	fmtFatalErr(err)
+	defer a.Close()
+	root, _ := a.RootHash()
+	fmtPrintf("Signed:  %s\nRoot:    %x\nSigner:  %x\n", arpath, root, a.Signer())
+}
+
+// VerifyArchive checks the archive is signed by the key given by --pubkey and every file matches
+// its hash, it exits with 1 if not
+func VerifyArchive(arpath, password string) {
+	a, err := arp.OpenArchive(arpath, password, false, trustedKeys()...)
+	fmtFatalErr(err)
+	defer a.Close()
+	fmtFatalErr(a.VerifyContents())
+	root, _ := a.RootHash()
+	fmtPrintf("Verified: %s\nRoot:     %x\nSigner:   %x\n", arpath, root, a.Signer())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/gowebp"
+	"github.com/coyove/gowebp/arp"
+	"github.com/dlclark/regexp2"
+)
+
+// transcoded entries are stored as "path" + webpSuffix
+const webpSuffix = ".webp"
+
+// transcodeRule matches files either by extension or by pattern
+type transcodeRule struct {
+	ext      string
+	pattern  *regexp2.Regexp
+	lossless bool
+	quality  float32
+}
+
+// parseTranscodeRules parses rules in the form of "match:setting,match:setting,...",
+// match is an extension like ".jpg" or a regex wrapped in slashes like "/^photos\//",
+// setting is a quality (0 ~ 100) or "lossless".
+// A sole quality is short for ".jpg:q,.jpeg:q,.png:lossless"
+func parseTranscodeRules(spec string) []transcodeRule {
+	if _, err := strconv.ParseFloat(spec, 32); err == nil {
+		spec = ".jpg:" + spec + ",.jpeg:" + spec + ",.png:lossless"
+	}
+
+	rules := []transcodeRule{}
+	for _, part := range strings.Split(spec, ",") {
+		idx := strings.LastIndex(part, ":")
+		if idx == -1 {
+			panicf("invalid transcode rule: %s", part)
+		}
+
+		match, setting := part[:idx], part[idx+1:]
+		r := transcodeRule{}
+
+		if setting == "lossless" {
+			// quality controls the compression effort in lossless mode
+			r.lossless, r.quality = true, 75
+		} else {
+			q, err := strconv.ParseFloat(setting, 32)
+			if err != nil || q < 0 || q > 100 {
+				panicf("invalid transcode quality: %s", setting)
+			}
+			r.quality = float32(q)
+		}
+
+		if len(match) > 2 && match[0] == '/' && match[len(match)-1] == '/' {
+			r.pattern = regexp2.MustCompile(match[1:len(match)-1], 0)
+		} else if strings.HasPrefix(match, ".") {
+			r.ext = strings.ToLower(match)
+		} else {
+			panicf("invalid transcode match: %s", match)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matchTranscodeRule returns the first rule matching path, nil if none
+func matchTranscodeRule(path string) *transcodeRule {
+	ext := strings.ToLower(filepath.Ext(path))
+	for i, r := range flags.transcode {
+		if r.pattern != nil {
+			if b, err := r.pattern.MatchString(path); b && err == nil {
+				return &flags.transcode[i]
+			}
+		} else if r.ext == ext {
+			return &flags.transcode[i]
+		}
+	}
+	return nil
+}
+
+// transcodeImage re-encodes the jpeg/png file into webp,
+// it returns nil if the file isn't an image or the result isn't smaller than the original
+func transcodeImage(path string, r *transcodeRule) ([]byte, *arp.TranscodeInfo, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := &arp.TranscodeInfo{
+		MIME: http.DetectContentType(buf),
+		Size: int64(len(buf)),
+		Hash: sha256.Sum256(buf),
+	}
+	if info.MIME != "image/jpeg" && info.MIME != "image/png" {
+		return nil, nil, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %v", path, err)
+	}
+
+	opts := gowebp.DefaultEncoderOptions(r.quality)
+	opts.Lossless = r.lossless
+	if exif := jpegExif(buf); exif != nil {
+		// photos are rotated upright, and EXIF is kept with the orientation reset
+		img = gowebp.Orient(img, gowebp.ExifOrientation(exif))
+		opts.EXIF, opts.ResetOrientation = exif, true
+	}
+
+	out := &bytes.Buffer{}
+	if err := gowebp.Encode(out, img, opts); err != nil {
+		return nil, nil, fmt.Errorf("encode %s: %v", path, err)
+	}
+	if out.Len() >= len(buf) {
+		return nil, nil, nil
+	}
+	return out.Bytes(), info, nil
+}
+
+// jpegExif returns the EXIF of a jpeg without the "Exif\x00\x00" prefix of APP1, nil if not found
+func jpegExif(buf []byte) []byte {
+	if len(buf) < 2 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(buf) && buf[i] == 0xff; {
+		marker := buf[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// metadata comes before the scan
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if n < 2 || i+2+n > len(buf) {
+			return nil
+		}
+		if seg := buf[i+4 : i+2+n]; marker == 0xe1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return seg[6:]
+		}
+		i += 2 + n
+	}
+	return nil
+}
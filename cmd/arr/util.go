@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/coyove/gowebp/arp"
 	"github.com/dlclark/regexp2"
 )
 
@@ -23,6 +24,7 @@ var flags struct {
 	action       byte
 	verbose      bool
 	checksum     bool
+	json         bool
 	deloriginal  bool
 	ignoreerrors bool
 	delimm       bool
@@ -31,6 +33,13 @@ var flags struct {
 	paths        []string
 	xdest        string
 	pattern      *regexp2.Regexp
+	transcode    []transcodeRule
+	codec        arp.Codec // files are stored as is unless Z picks a codec
+	glob         string
+	output       string
+	prefixes     map[int]string // prefixes of paths by their positions
+	conflict     arp.ConflictPolicy
+	pubkey       string // the trusted key of signed archives
 }
 
 func panicf(format string, a ...interface{}) {
@@ -39,24 +48,57 @@ func panicf(format string, a ...interface{}) {
 
 func parseFlags() {
 	usage := func() {
-		fmt.Printf("Usage: arr [axlwj]vpPXkCfL\n")
+		fmt.Printf("Usage: arr [axlwjudm]vpPXkJCfLWZM\n")
+		fmt.Printf("       arr d <archive> <pattern>\n")
+		fmt.Printf("       arr m <output> <archive>[=prefix] ... [-M newest|first|fail|rename]\n")
+		fmt.Printf("       arr compact <archive>\n")
+		fmt.Printf("       arr diff <archive> <dir|archive> [-k] [-J]\n")
+		fmt.Printf("       arr recover <archive>\n")
+		fmt.Printf("       arr sign <archive> <private key>\n")
+		fmt.Printf("       arr verify <archive> --pubkey <public key>\n")
+		fmt.Printf("       keys are ed25519 in PEM, --pubkey also makes x, l and w reject unsigned archives\n")
 	}
 
 	defer func() {
 		if r := recover(); r != nil {
 			usage()
 			fmt.Printf("Invalid argument(s):\n%v\n", r)
+			if flags.action == 'D' {
+				// 1 means differences found
+				os.Exit(2)
+			}
 			os.Exit(1)
 		}
 	}()
 
 	args := os.Args
 	flags.paths = make([]string, 0)
+	flags.prefixes = map[int]string{}
 	flags.xdest, _ = filepath.Abs(".")
 	nextIs := '\x00'
 
 	for i := 1; i < len(args); i++ {
 		arg := args[i]
+		if flags.action == 'd' && len(flags.paths) == 1 && flags.glob == "" && nextIs == 0 && !strings.HasPrefix(arg, "-") {
+			flags.glob = arg
+			continue
+		}
+
+		if flags.action == 'm' && nextIs == 0 && !strings.HasPrefix(arg, "-") {
+			if flags.output == "" {
+				flags.output, _ = filepath.Abs(arg)
+				continue
+			}
+			if i := strings.LastIndex(arg, "="); i > 0 {
+				if _, err := os.Stat(arg[:i]); err == nil {
+					path, _ := filepath.Abs(arg[:i])
+					flags.prefixes[len(flags.paths)] = arg[i+1:]
+					flags.paths = append(flags.paths, path)
+					continue
+				}
+			}
+		}
+
 		if _, err := os.Stat(arg); err == nil {
 			arg, _ = filepath.Abs(arg)
 			arg = strings.Replace(arg, "\\", "/", -1)
@@ -68,6 +110,9 @@ func parseFlags() {
 			if nextIs == 'C' {
 				nextIs = 0
 				flags.xdest = arg
+			} else if nextIs == 'K' {
+				nextIs = 0
+				flags.pubkey = arg
 			} else {
 				flags.paths = append(flags.paths, arg)
 			}
@@ -91,6 +136,30 @@ func parseFlags() {
 			nextIs = 0
 			flags.password = arg
 			continue
+		case 'W':
+			nextIs = 0
+			flags.transcode = parseTranscodeRules(arg)
+			continue
+		case 'Z':
+			nextIs = 0
+			c, err := arp.ParseCodec(arg)
+			if err != nil {
+				panic(err)
+			}
+			flags.codec = c
+			continue
+		case 'K':
+			nextIs = 0
+			flags.pubkey = arg
+			continue
+		case 'M':
+			nextIs = 0
+			p, err := arp.ParseConflictPolicy(arg)
+			if err != nil {
+				panic(err)
+			}
+			flags.conflict = p
+			continue
 		}
 
 		for strings.HasPrefix(arg, "-") {
@@ -102,16 +171,29 @@ func parseFlags() {
 			os.Exit(0)
 		}
 
+		if arg == "pubkey" {
+			nextIs = 'K'
+			continue
+		}
+
+		if a, ok := map[string]byte{"compact": 'c', "diff": 'D', "recover": 'r', "sign": 's', "verify": 'V'}[arg]; ok {
+			if flags.action != 0 {
+				panicf("conflict arguments: %s and %s", arg, string(flags.action))
+			}
+			flags.action = a
+			continue
+		}
+
 		for _, p := range arg {
 			switch p {
-			case 'a', 'x', 'l', 'w', 'j':
+			case 'a', 'x', 'l', 'w', 'j', 'u', 'd', 'm':
 				if flags.action != 0 {
 					panicf("conflict arguments: %s and %s", string(p), string(flags.action))
 				}
 				flags.action = byte(p)
 			case 'v':
 				flags.verbose = true
-			case 'C', 'L', 'p', 'P':
+			case 'C', 'L', 'p', 'P', 'W', 'Z', 'M':
 				nextIs = p
 			case 'X':
 				if flags.deloriginal {
@@ -120,6 +202,8 @@ func parseFlags() {
 				flags.deloriginal = true
 			case 'k':
 				flags.checksum = true
+			case 'J':
+				flags.json = true
 			case 'f':
 				flags.ignoreerrors = true
 			default:
@@ -128,7 +212,7 @@ func parseFlags() {
 		}
 	}
 
-	if flags.action == 'l' {
+	if strings.IndexByte("ldcrsV", flags.action) >= 0 {
 		flags.verbose = true
 	}
 
@@ -144,6 +228,35 @@ func parseFlags() {
 	if len(flags.paths) == 0 {
 		panicf("please provide at least one path")
 	}
+
+	if flags.action == 'd' && (len(flags.paths) != 1 || flags.glob == "") {
+		panicf("please provide the archive and the pattern of entries to delete")
+	}
+
+	if flags.action == 'D' && len(flags.paths) != 2 {
+		panicf("please provide the archive and the directory or archive to compare with")
+	}
+
+	if flags.action == 's' && len(flags.paths) != 2 {
+		panicf("please provide the archive and the private key to sign it with")
+	}
+
+	if flags.action == 'V' && flags.pubkey == "" {
+		panicf("please provide the public key to verify with by --pubkey")
+	}
+
+	if flags.action == 'm' && flags.output == "" {
+		panicf("please provide the output archive")
+	}
+
+	if flags.action == 'u' {
+		if len(flags.paths) != 2 {
+			panicf("please provide the archive and the directory to update it from")
+		}
+		if st, _ := os.Stat(flags.paths[1]); !st.IsDir() {
+			panicf("can't update from a single file: %s", flags.paths[1])
+		}
+	}
 }
 
 func fmtPrintln(args ...interface{}) {
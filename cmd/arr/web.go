@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/gowebp"
+	"github.com/coyove/gowebp/arp"
+)
+
+const (
+	thumbSize     = 200
+	thumbQuality  = 75
+	thumbCacheMax = 64 << 20
+	jpegQuality   = 90
+)
+
+const galleryStyle = `
+					<style>.g{display:flex;flex-wrap:wrap}.g a{display:block;width:220px;margin:4px;text-align:center;word-break:break-all}
+					.g img{width:200px;height:200px;object-fit:contain;background:#eee}.meta td{width:auto}</style>`
+
+// webServer serves the archive over http, reads of the archive are safe to run concurrently
+type webServer struct {
+	a          *arp.Archive
+	transcoded map[string]*arp.TranscodeInfo
+
+	thumbMu    sync.Mutex
+	thumbs     map[[sha256.Size]byte][]byte
+	thumbBytes int
+}
+
+func newWebServer(a *arp.Archive) (*webServer, error) {
+	s := &webServer{a: a, thumbs: map[[sha256.Size]byte][]byte{}}
+	var err error
+	s.transcoded, err = a.TranscodeInfos()
+	return s, err
+}
+
+func isImagePath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	}
+	return false
+}
+
+// href escapes path into an absolute url with the optional query
+func href(path, query string) string {
+	u := &url.URL{Path: "/" + path, RawQuery: query}
+	return html.EscapeString(u.String())
+}
+
+func (s *webServer) read(path string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	_, err := s.a.Stream(buf, path)
+	return buf.Bytes(), err
+}
+
+// images returns the sorted image entries directly under dir
+func (s *webServer) images(dir string) []*arp.EntryInfo {
+	res := []*arp.EntryInfo{}
+	s.a.Iterate(func(info *arp.EntryInfo, start, l uint64) error {
+		if !info.IsDir && isUnder(dir, info.Path) && isImagePath(info.Path) {
+			res = append(res, info)
+		}
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res
+}
+
+func (s *webServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Path
+	if len(uri) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	uri = uri[1:]
+	if strings.HasSuffix(uri, "/") {
+		uri = uri[:len(uri)-1]
+	}
+
+	q := r.URL.Query()
+	if _, _, ok := s.a.GetFile(uri); ok {
+		switch {
+		case q["thumb"] != nil:
+			s.serveThumb(w, r, uri)
+		case q["view"] != nil:
+			s.serveLightbox(w, uri)
+		default:
+			s.serveFile(w, r, uri)
+		}
+		return
+	}
+
+	if q["gallery"] != nil {
+		s.serveGallery(w, uri)
+		return
+	}
+	s.serveDir(w, uri)
+}
+
+func (s *webServer) serveDir(w http.ResponseWriter, uri string) {
+	const tf = "2006-01-02 15:04:05"
+	a := s.a
+
+	w.Write([]byte(fmt.Sprintf(htmlHeader+`
+					<div>Total entries: %d, created at: %s</div>
+					`, flags.paths[0], a.TotalEntries(), a.Created.Format(tf))))
+
+	if n := len(s.images(uri)); n > 0 {
+		w.Write([]byte(fmt.Sprintf(`<div><a href="%s">Gallery</a> (%d images)</div>`, href(uri, "gallery"), n)))
+	}
+
+	w.Write([]byte(`
+					<table border=1 style="border-collapse:collapse">
+					<tr><td> Mode </td><td> Modtime </td><td> Offset </td><td align=right> Size </td><td></td></tr>
+					<tr><td></td><td></td><td></td><td></td><td class=dir><a href="javascript:up()">..</a></td></tr>
+					`))
+
+	a.Iterate(func(info *arp.EntryInfo, start, l uint64) error {
+		if !isUnder(uri, info.Path) || info.Path == "." {
+			return nil
+		}
+
+		if info.IsDir {
+			w.Write([]byte(fmt.Sprintf(`<tr>
+							<td>%s</td>
+							<td>%s</td>
+							<td>Fdir</td>
+							<td align=right>-</td>
+							<td class=dir><a href='/%s'>%s</a></td>
+						</tr>`,
+				uint32mod(info.Mode),
+				info.Modtime.Format(tf), info.Path, filepath.Base(info.Path),
+			)))
+		} else {
+			w.Write([]byte(fmt.Sprintf(`<tr>
+						<td>%s</td>
+						<td>%s</td>
+						<td>0x%010x</td>
+						<td align=right>%d</td>
+						<td><a href='/%s'>%s</a></td>
+					</tr>`,
+				uint32mod(info.Mode),
+				info.Modtime.Format(tf), start, l, info.Path, filepath.Base(info.Path),
+			)))
+		}
+		return nil
+	})
+
+	w.Write([]byte("</table></html>"))
+}
+
+// serveFile serves the file like http.ServeContent: ranges, conditional requests and a strong
+// ETag from the stored hash. Webp images converted for the client get their own ETag
+func (s *webServer) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	info, _ := s.a.GetInfo(path)
+	etag := fmt.Sprintf(`"%x"`, info.Hash)
+
+	if strings.EqualFold(filepath.Ext(path), ".webp") {
+		w.Header().Add("Vary", "Accept")
+		if !acceptsWebP(r) {
+			buf, err := s.read(path)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ct, out, err := convertWebP(buf)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", ct)
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%s"`, info.Hash, strings.TrimPrefix(ct, "image/")))
+			http.ServeContent(w, r, path, info.Modtime, bytes.NewReader(out))
+			return
+		}
+		w.Header().Set("Content-Type", "image/webp")
+	}
+
+	f, err := s.a.OpenEntry(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Content-Type is set by the extension, or sniffed from the content
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, path, info.Modtime, f)
+}
+
+// acceptsWebP tells whether the client lists image/webp in Accept, wildcards don't count
+// because browsers without webp support send them as well
+func acceptsWebP(r *http.Request) bool {
+	for _, v := range r.Header["Accept"] {
+		for _, part := range strings.Split(v, ",") {
+			params := strings.Split(part, ";")
+			if strings.ToLower(strings.TrimSpace(params[0])) != "image/webp" {
+				continue
+			}
+			for _, p := range params[1:] {
+				if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "q" {
+					if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// writeWebP writes webp to the client as is, or converts it if the client doesn't accept webp
+func writeWebP(w http.ResponseWriter, r *http.Request, webp []byte) {
+	w.Header().Add("Vary", "Accept")
+	if acceptsWebP(r) {
+		w.Header().Set("Content-Type", "image/webp")
+		w.Write(webp)
+		return
+	}
+
+	ct, out, err := convertWebP(webp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Write(out)
+}
+
+// convertWebP converts webp into png (for images with alpha or animations, of which only
+// the first frame is kept) or jpeg
+func convertWebP(webp []byte) (string, []byte, error) {
+	d, err := gowebp.NewDemuxer(webp)
+	if err != nil {
+		return "", nil, err
+	}
+	defer d.Close()
+
+	out := &bytes.Buffer{}
+	if d.FrameCount() > 1 || d.Frames[0].HasAlpha {
+		img, err := d.CompositeFrame(0, nil)
+		if err == nil {
+			err = png.Encode(out, img)
+		}
+		return "image/png", out.Bytes(), err
+	}
+	err = gowebp.DecodeToJPEG(out, webp, &jpeg.Options{Quality: jpegQuality})
+	return "image/jpeg", out.Bytes(), err
+}
+
+func (s *webServer) serveGallery(w http.ResponseWriter, uri string) {
+	w.Write([]byte(fmt.Sprintf(htmlHeader+galleryStyle+`
+					<div><a href="%s">Back to list</a></div><div class=g>`, flags.paths[0], href(uri, ""))))
+
+	for _, info := range s.images(uri) {
+		w.Write([]byte(fmt.Sprintf(`<a href="%s"><img src="%s" loading=lazy><br>%s</a>`,
+			href(info.Path, "view"), href(info.Path, "thumb"), html.EscapeString(filepath.Base(info.Path)))))
+	}
+
+	w.Write([]byte("</div></html>"))
+}
+
+func (s *webServer) serveThumb(w http.ResponseWriter, r *http.Request, path string) {
+	thumb, err := s.thumbnail(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=86400")
+	writeWebP(w, r, thumb)
+}
+
+// thumbnail returns the cached thumbnail of path, or generates one. The cache is keyed by
+// the entry hash so identical files share the same thumbnail
+func (s *webServer) thumbnail(path string) ([]byte, error) {
+	info, ok := s.a.GetInfo(path)
+	if !ok {
+		return nil, fmt.Errorf("%s not found", path)
+	}
+
+	s.thumbMu.Lock()
+	thumb, ok := s.thumbs[info.Hash]
+	s.thumbMu.Unlock()
+	if ok {
+		return thumb, nil
+	}
+
+	buf, err := s.read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodeThumb(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	if err := gowebp.Encode(out, img, gowebp.DefaultEncoderOptions(thumbQuality)); err != nil {
+		return nil, err
+	}
+	thumb = out.Bytes()
+
+	s.thumbMu.Lock()
+	if s.thumbBytes+len(thumb) > thumbCacheMax {
+		// simply start over when the cache is full
+		s.thumbs, s.thumbBytes = map[[sha256.Size]byte][]byte{}, 0
+	}
+	s.thumbs[info.Hash] = thumb
+	s.thumbBytes += len(thumb)
+	s.thumbMu.Unlock()
+	return thumb, nil
+}
+
+// thumbFit returns the size which fits w x h into the thumbnail box
+func thumbFit(w, h int) (int, int) {
+	if w <= thumbSize && h <= thumbSize {
+		return w, h
+	}
+	if w >= h {
+		return thumbSize, max1((h*thumbSize + w/2) / w)
+	}
+	return max1((w*thumbSize + h/2) / h), thumbSize
+}
+
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+func decodeThumb(buf []byte) (image.Image, error) {
+	if len(buf) == 0 || !gowebp.IsWebPFormat(buf) {
+		img, _, err := image.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		return scaleDown(img), nil
+	}
+
+	d, err := gowebp.NewDemuxer(buf)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	if d.FrameCount() > 1 {
+		// animations can't be scaled while decoding, use the first frame
+		img, err := d.CompositeFrame(0, nil)
+		if err != nil {
+			return nil, err
+		}
+		return scaleDown(img), nil
+	}
+
+	tw, th := thumbFit(d.Width, d.Height)
+	return gowebp.DecodeWithOptions(buf, &gowebp.DecoderOptions{ScaledWidth: tw, ScaledHeight: th})
+}
+
+// scaleDown shrinks img into the thumbnail box by averaging the covered source pixels
+func scaleDown(img image.Image) image.Image {
+	b := img.Bounds()
+	tw, th := thumbFit(b.Dx(), b.Dy())
+	if tw == b.Dx() && th == b.Dy() {
+		return img
+	}
+
+	src, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*sh/th, (y+1)*sh/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*sw/tw, (x+1)*sw/tw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					// weight the colors by alpha so transparent pixels don't bleed
+					a := int(p[3])
+					sum[0] += int(p[0]) * a
+					sum[1] += int(p[1]) * a
+					sum[2] += int(p[2]) * a
+					sum[3] += a
+				}
+			}
+			if sum[3] == 0 {
+				continue
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(sum[0] / sum[3])
+			d[1] = uint8(sum[1] / sum[3])
+			d[2] = uint8(sum[2] / sum[3])
+			d[3] = uint8(sum[3] / ((y1 - y0) * (x1 - x0)))
+		}
+	}
+	return dst
+}
+
+// imageMeta collects the displayable metadata of an archived image
+func (s *webServer) imageMeta(path string, buf []byte) [][2]string {
+	meta := [][2]string{{"Size", fmt.Sprintf("%d bytes / %s", len(buf), humansize(int64(len(buf))))}}
+	if t := s.transcoded[path]; t != nil {
+		meta = append(meta, [2]string{"Original", fmt.Sprintf("%s, %s, sha256 %x", t.MIME, humansize(t.Size), t.Hash)})
+	}
+
+	if len(buf) == 0 || !gowebp.IsWebPFormat(buf) {
+		config, format, err := image.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			return append(meta, [2]string{"Error", err.Error()})
+		}
+		return append(meta,
+			[2]string{"Format", format},
+			[2]string{"Dimensions", fmt.Sprintf("%d x %d", config.Width, config.Height)})
+	}
+
+	d, err := gowebp.NewDemuxer(buf)
+	if err != nil {
+		return append(meta, [2]string{"Error", err.Error()})
+	}
+	defer d.Close()
+
+	format := "lossy"
+	if frag, _ := d.Fragment(0); len(frag) >= 4 && string(frag[:4]) == "VP8L" {
+		format = "lossless"
+	}
+	meta = append(meta,
+		[2]string{"Format", "webp, " + format},
+		[2]string{"Dimensions", fmt.Sprintf("%d x %d", d.Width, d.Height)},
+		[2]string{"Alpha", fmt.Sprint(d.Frames[0].HasAlpha)})
+
+	if n := d.FrameCount(); n > 1 {
+		var total time.Duration
+		for _, f := range d.Frames {
+			total += f.Duration
+		}
+		loop := "infinite"
+		if d.LoopCount > 0 {
+			loop = fmt.Sprint(d.LoopCount)
+		}
+		meta = append(meta, [2]string{"Animation", fmt.Sprintf("%d frames, %v, loop: %s", n, total, loop)})
+	}
+
+	for _, c := range []struct{ fourcc, name string }{{"ICCP", "ICC profile"}, {"EXIF", "EXIF"}, {"XMP ", "XMP"}} {
+		chunk := gowebp.ReadChunk(buf, c.fourcc)
+		if chunk == nil {
+			continue
+		}
+		v := humansize(int64(len(chunk)))
+		if c.fourcc == "EXIF" {
+			if o := gowebp.ExifOrientation(chunk); o > 0 {
+				v += fmt.Sprintf(", orientation: %d", o)
+			}
+		}
+		meta = append(meta, [2]string{c.name, v})
+	}
+	return meta
+}
+
+func (s *webServer) serveLightbox(w http.ResponseWriter, path string) {
+	buf, err := s.read(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dir := filepath.Dir(path)
+	if dir == "." {
+		dir = ""
+	}
+
+	var prev, next string
+	images := s.images(dir)
+	for i, info := range images {
+		if info.Path != path {
+			continue
+		}
+		if i > 0 {
+			prev = images[i-1].Path
+		}
+		if i < len(images)-1 {
+			next = images[i+1].Path
+		}
+	}
+
+	w.Write([]byte(fmt.Sprintf(htmlHeader+galleryStyle+`
+					<div><a href="%s">Gallery</a>`, html.EscapeString(path), href(dir, "gallery"))))
+	if prev != "" {
+		w.Write([]byte(fmt.Sprintf(` | <a href="%s">Prev</a>`, href(prev, "view"))))
+	}
+	if next != "" {
+		w.Write([]byte(fmt.Sprintf(` | <a href="%s">Next</a>`, href(next, "view"))))
+	}
+	w.Write([]byte(fmt.Sprintf(` | <a href="%s">%s</a></div><table class=meta border=1 style="border-collapse:collapse">`,
+		href(path, ""), html.EscapeString(filepath.Base(path)))))
+
+	for _, kv := range s.imageMeta(path, buf) {
+		w.Write([]byte(fmt.Sprintf("<tr><td>%s</td><td>%s</td></tr>", kv[0], html.EscapeString(kv[1]))))
+	}
+
+	w.Write([]byte(fmt.Sprintf(`</table><div><img src="%s" style="max-width:100%%"></div></html>`, href(path, ""))))
+}
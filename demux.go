@@ -0,0 +1,319 @@
+package gowebp
+
+/*
+#include <stdlib.h>
+#include <webp/decode.h>
+#include <webp/demux.h>
+
+struct FrameInfo {
+	int x_offset;
+	int y_offset;
+	int width;
+	int height;
+	int duration;
+	int dispose;
+	int blend;
+	int has_alpha;
+	int complete;
+	const uint8_t* fragment;
+	size_t fragment_size;
+} FrameInfo;
+
+WebPDemuxer* DemuxNew(const uint8_t* data, size_t data_len) {
+	WebPData d;
+	d.bytes = data;
+	d.size = data_len;
+	return WebPDemux(&d);
+}
+
+// frame number starts from 1, as libwebp does
+int DemuxFrame(const WebPDemuxer* dmux, int n, struct FrameInfo* f) {
+	WebPIterator iter;
+	if (!WebPDemuxGetFrame(dmux, n, &iter)) {
+		return 0;
+	}
+	f->x_offset = iter.x_offset;
+	f->y_offset = iter.y_offset;
+	f->width = iter.width;
+	f->height = iter.height;
+	f->duration = iter.duration;
+	f->dispose = (int)iter.dispose_method;
+	f->blend = (int)iter.blend_method;
+	f->has_alpha = iter.has_alpha;
+	f->complete = iter.complete;
+	f->fragment = iter.fragment.bytes;
+	f->fragment_size = iter.fragment.size;
+	WebPDemuxReleaseIterator(&iter);
+	return 1;
+}
+
+// find the first chunk of fourcc, returns its offset and size in data
+int DemuxChunk(const uint8_t* data, size_t data_len, const char* fourcc, size_t* offset, size_t* size) {
+	WebPData d;
+	WebPDemuxer* dmux;
+	WebPChunkIterator iter;
+	int found;
+
+	d.bytes = data;
+	d.size = data_len;
+	dmux = WebPDemux(&d);
+	if (dmux == NULL) {
+		return 0;
+	}
+
+	found = WebPDemuxGetChunk(dmux, fourcc, 1, &iter);
+	if (found) {
+		*offset = iter.chunk.bytes - data;
+		*size = iter.chunk.size;
+		WebPDemuxReleaseChunkIterator(&iter);
+	}
+	WebPDemuxDelete(dmux);
+	return found;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+	"unsafe"
+)
+
+// ReadChunk returns the payload of the first chunk with the given fourcc (e.g. "EXIF", "XMP ", "ICCP"),
+// nil if not found. The result shares the memory with webp
+func ReadChunk(webp []byte, fourcc string) []byte {
+	if len(webp) == 0 || len(fourcc) != 4 {
+		return nil
+	}
+
+	cs := C.CString(fourcc)
+	defer C.free(unsafe.Pointer(cs))
+
+	var offset, size C.size_t
+	if C.DemuxChunk((*C.uint8_t)(&webp[0]), C.size_t(len(webp)), cs, &offset, &size) == 0 {
+		return nil
+	}
+	return webp[offset : offset+size : offset+size]
+}
+
+// DisposeMethod tells how a frame should be disposed before rendering the next one
+type DisposeMethod int
+
+const (
+	DisposeNone       DisposeMethod = iota // leave the canvas as is
+	DisposeBackground                      // clear the frame rectangle to transparent
+)
+
+// BlendMethod tells how a frame should be blended with the previous canvas
+type BlendMethod int
+
+const (
+	BlendAlpha BlendMethod = iota // alpha-blend the frame over the canvas
+	BlendNone                     // overwrite the frame rectangle
+)
+
+// FrameInfo describes a single frame of a webp
+type FrameInfo struct {
+	X, Y          int // offset relative to the canvas
+	Width, Height int
+	Duration      time.Duration
+	Dispose       DisposeMethod
+	Blend         BlendMethod
+	HasAlpha      bool
+	Keyframe      bool // the frame can be rendered without any earlier frames
+
+	// Offset and Size locate the raw frame fragment (ALPH + VP8/VP8L chunks) inside the webp
+	Offset, Size int
+
+	fragment *C.uint8_t
+}
+
+// Demuxer provides random access to the frames of an (animated) webp
+type Demuxer struct {
+	Width, Height   int
+	LoopCount       int // 0 means infinite
+	BackgroundColor color.NRGBA
+	Frames          []FrameInfo
+
+	data unsafe.Pointer
+	dmux *C.WebPDemuxer
+}
+
+var ErrFrameOutOfRange = errors.New("webp demux: frame out of range")
+
+// ErrDemuxerClosed is returned by frame accessors after Close, frames point into the released data
+var ErrDemuxerClosed = errors.New("webp demux: demuxer is closed")
+
+// NewDemuxer parses webp and collects the info of all frames, no frame will be decoded.
+// The data is copied, Close must be called to release it
+func NewDemuxer(webp []byte) (*Demuxer, error) {
+	if len(webp) == 0 {
+		return nil, errors.New("webp demux: empty data")
+	}
+
+	d := &Demuxer{data: C.CBytes(webp)}
+	d.dmux = C.DemuxNew((*C.uint8_t)(d.data), C.size_t(len(webp)))
+	if d.dmux == nil {
+		C.free(d.data)
+		return nil, errors.New("webp demux: invalid data")
+	}
+
+	d.Width = int(C.WebPDemuxGetI(d.dmux, C.WEBP_FF_CANVAS_WIDTH))
+	d.Height = int(C.WebPDemuxGetI(d.dmux, C.WEBP_FF_CANVAS_HEIGHT))
+	d.LoopCount = int(C.WebPDemuxGetI(d.dmux, C.WEBP_FF_LOOP_COUNT))
+
+	// stored as [blue, green, red, alpha] in the file
+	bg := uint32(C.WebPDemuxGetI(d.dmux, C.WEBP_FF_BACKGROUND_COLOR))
+	d.BackgroundColor = color.NRGBA{R: uint8(bg >> 16), G: uint8(bg >> 8), B: uint8(bg), A: uint8(bg >> 24)}
+
+	count := int(C.WebPDemuxGetI(d.dmux, C.WEBP_FF_FRAME_COUNT))
+	d.Frames = make([]FrameInfo, count)
+
+	for i := range d.Frames {
+		f := C.struct_FrameInfo{}
+		if C.DemuxFrame(d.dmux, C.int(i+1), &f) == 0 || f.complete == 0 {
+			d.Close()
+			return nil, fmt.Errorf("webp demux: frame %d is incomplete", i)
+		}
+
+		fi := &d.Frames[i]
+		fi.X, fi.Y = int(f.x_offset), int(f.y_offset)
+		fi.Width, fi.Height = int(f.width), int(f.height)
+		fi.Duration = time.Duration(f.duration) * time.Millisecond
+		fi.Dispose = DisposeMethod(f.dispose)
+		fi.Blend = BlendMethod(f.blend)
+		fi.HasAlpha = f.has_alpha != 0
+		fi.Offset = int(uintptr(unsafe.Pointer(f.fragment)) - uintptr(d.data))
+		fi.Size = int(f.fragment_size)
+		fi.fragment = f.fragment
+		fi.Keyframe = d.isKeyframe(i)
+	}
+
+	return d, nil
+}
+
+// isKeyframe follows IsKeyFrame in src/demux/anim_decode.c
+func (d *Demuxer) isKeyframe(i int) bool {
+	if i == 0 {
+		return true
+	}
+
+	cur, prev := &d.Frames[i], &d.Frames[i-1]
+	if (!cur.HasAlpha || cur.Blend == BlendNone) && d.isFullFrame(cur) {
+		return true
+	}
+	return prev.Dispose == DisposeBackground && (d.isFullFrame(prev) || prev.Keyframe)
+}
+
+func (d *Demuxer) isFullFrame(f *FrameInfo) bool {
+	return f.Width == d.Width && f.Height == d.Height
+}
+
+// Close releases the demuxer and its copy of data, frames can't be read afterwards
+func (d *Demuxer) Close() {
+	if d.dmux != nil {
+		C.WebPDemuxDelete(d.dmux)
+		C.free(d.data)
+		d.dmux, d.data = nil, nil
+	}
+}
+
+func (d *Demuxer) checkFrame(n int) error {
+	if d.dmux == nil {
+		return ErrDemuxerClosed
+	}
+	if n < 0 || n >= len(d.Frames) {
+		return ErrFrameOutOfRange
+	}
+	return nil
+}
+
+// FrameCount returns the number of frames, a still webp has exactly one frame
+func (d *Demuxer) FrameCount() int {
+	return len(d.Frames)
+}
+
+// Fragment returns a copy of the raw frame fragment n (starting from 0),
+// it can be decoded by Decode and friends directly
+func (d *Demuxer) Fragment(n int) ([]byte, error) {
+	if err := d.checkFrame(n); err != nil {
+		return nil, err
+	}
+	f := &d.Frames[n]
+	return C.GoBytes(unsafe.Pointer(f.fragment), C.int(f.Size)), nil
+}
+
+// DecodeFrame decodes the raw frame n (starting from 0) into image.NRGBA,
+// the result has the size of the frame rather than the canvas and isn't composited
+func (d *Demuxer) DecodeFrame(n int, opts *DecoderOptions) (*image.NRGBA, error) {
+	if err := d.checkFrame(n); err != nil {
+		return nil, err
+	}
+	f := &d.Frames[n]
+	return decodeNRGBA(f.fragment, C.size_t(f.Size), opts)
+}
+
+// CompositeFrame renders frame n (starting from 0) onto a canvas sized image.NRGBA,
+// only frames from the nearest keyframe at or before n will be decoded
+func (d *Demuxer) CompositeFrame(n int, opts *DecoderOptions) (*image.NRGBA, error) {
+	if err := d.checkFrame(n); err != nil {
+		return nil, err
+	}
+
+	key := n
+	for !d.Frames[key].Keyframe {
+		key--
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, d.Width, d.Height))
+	for i := key; i <= n; i++ {
+		f := &d.Frames[i]
+		img, err := d.DecodeFrame(i, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		blend := i > key && f.Blend == BlendAlpha
+		for y := 0; y < f.Height; y++ {
+			src := img.Pix[y*img.Stride : y*img.Stride+f.Width*4]
+			dst := canvas.Pix[(f.Y+y)*canvas.Stride+f.X*4:]
+			if !blend {
+				copy(dst, src)
+				continue
+			}
+			for x := 0; x < len(src); x += 4 {
+				blendNonPremult(dst[x:x+4], src[x:x+4])
+			}
+		}
+
+		if i < n && f.Dispose == DisposeBackground {
+			for y := 0; y < f.Height; y++ {
+				row := canvas.Pix[(f.Y+y)*canvas.Stride+f.X*4:]
+				for x := 0; x < f.Width*4; x++ {
+					row[x] = 0
+				}
+			}
+		}
+	}
+	return canvas, nil
+}
+
+// blendNonPremult blends src over dst, follows BlendPixelNonPremult in src/demux/anim_decode.c
+func blendNonPremult(dst, src []byte) {
+	srcA := uint32(src[3])
+	if srcA == 0 {
+		return
+	}
+
+	dstFactorA := (uint32(dst[3]) * (256 - srcA)) >> 8
+	blendA := srcA + dstFactorA
+	scale := (uint32(1) << 24) / blendA
+
+	for c := 0; c < 3; c++ {
+		dst[c] = uint8(((uint32(src[c])*srcA + uint32(dst[c])*dstFactorA) * scale) >> 24)
+	}
+	dst[3] = uint8(blendA)
+}
@@ -0,0 +1,127 @@
+package gowebp
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// anim.webp is a 32x32 animation looping 3 times with EXIF "Exif\x00\x00fake": an opaque red
+// keyframe, a half transparent blue square at (8, 8) which is disposed to the background,
+// then an opaque green square at (0, 0)
+func TestDemuxer(t *testing.T) {
+	webp := readFixture(t, "anim.webp")
+	d, err := NewDemuxer(webp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.Width != 32 || d.Height != 32 || d.LoopCount != 3 || d.FrameCount() != 3 {
+		t.Fatal("unexpected demuxer:", d.Width, d.Height, d.LoopCount, d.FrameCount())
+	}
+	for i, f := range d.Frames {
+		if f.Duration != time.Duration(i+1)*100*time.Millisecond {
+			t.Fatal(i, "unexpected duration:", f.Duration)
+		}
+		if f.Keyframe != (i == 0) {
+			t.Fatal(i, "unexpected keyframe:", f.Keyframe)
+		}
+		fragment, err := d.Fragment(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(webp[f.Offset:f.Offset+f.Size], fragment) {
+			t.Fatal(i, "fragment not matched")
+		}
+	}
+	if f := d.Frames[1]; f.X != 8 || f.Y != 8 || f.Width != 16 || !f.HasAlpha || f.Dispose != DisposeBackground {
+		t.Fatal("unexpected frame:", f)
+	}
+
+	img, err := d.DecodeFrame(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 16 || img.NRGBAAt(0, 0) != (color.NRGBA{0, 0, 255, 128}) {
+		t.Fatal("unexpected frame:", img.Bounds(), img.NRGBAAt(0, 0))
+	}
+
+	// blue blends over red
+	canvas, err := d.CompositeFrame(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := canvas.NRGBAAt(12, 12); !near(c.R, 127, 2) || c.G != 0 || !near(c.B, 128, 2) || c.A != 255 {
+		t.Fatal("unexpected blended color:", c)
+	}
+
+	// the blue square is disposed before the green one is drawn
+	canvas, err = d.CompositeFrame(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{4, 4, color.NRGBA{0, 255, 0, 255}},
+		{12, 12, color.NRGBA{0, 255, 0, 255}},
+		{20, 20, color.NRGBA{}},
+		{28, 28, color.NRGBA{255, 0, 0, 255}},
+		{20, 4, color.NRGBA{255, 0, 0, 255}},
+	} {
+		// blending opaque pixels may round 255 down to 254, as libwebp does
+		got := canvas.NRGBAAt(c.x, c.y)
+		if !near(got.R, c.want.R, 1) || !near(got.G, c.want.G, 1) || !near(got.B, c.want.B, 1) || got.A != c.want.A {
+			t.Fatal("unexpected color at", c.x, c.y, got)
+		}
+	}
+
+	for _, n := range []int{-1, 3} {
+		if _, err := d.Fragment(n); err != ErrFrameOutOfRange {
+			t.Fatal(n, "expect ErrFrameOutOfRange, got", err)
+		}
+		if _, err := d.DecodeFrame(n, nil); err != ErrFrameOutOfRange {
+			t.Fatal(n, "expect ErrFrameOutOfRange, got", err)
+		}
+		if _, err := d.CompositeFrame(n, nil); err != ErrFrameOutOfRange {
+			t.Fatal(n, "expect ErrFrameOutOfRange, got", err)
+		}
+	}
+
+	d.Close()
+	d.Close()
+	if _, err := d.Fragment(0); err != ErrDemuxerClosed {
+		t.Fatal("expect ErrDemuxerClosed, got", err)
+	}
+	if _, err := d.DecodeFrame(0, nil); err != ErrDemuxerClosed {
+		t.Fatal("expect ErrDemuxerClosed, got", err)
+	}
+	if _, err := d.CompositeFrame(2, nil); err != ErrDemuxerClosed {
+		t.Fatal("expect ErrDemuxerClosed, got", err)
+	}
+}
+
+func TestDemuxerInvalid(t *testing.T) {
+	if _, err := NewDemuxer(nil); err == nil {
+		t.Error("expect an error")
+	}
+	if _, err := NewDemuxer([]byte("RIFF\x00\x00\x00\x00WEBPVP8 ")); err == nil {
+		t.Error("expect an error")
+	}
+}
+
+func TestReadChunk(t *testing.T) {
+	webp := readFixture(t, "anim.webp")
+	if p := ReadChunk(webp, "EXIF"); string(p) != "Exif\x00\x00fake" {
+		t.Fatal("unexpected chunk:", p)
+	}
+	if p := ReadChunk(webp, "XMP "); p != nil {
+		t.Fatal("unexpected chunk:", p)
+	}
+	if ReadChunk(webp, "EXI") != nil || ReadChunk(nil, "EXIF") != nil {
+		t.Fatal("invalid arguments should return nil")
+	}
+}
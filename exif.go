@@ -0,0 +1,120 @@
+package gowebp
+
+import (
+	"encoding/binary"
+	"image"
+)
+
+const exifOrientationTag = 0x0112
+
+// exifOrientationOffset finds the value of the orientation tag in IFD0,
+// it returns the offset of the value inside exif and the byte order
+func exifOrientationOffset(exif []byte) (int, binary.ByteOrder) {
+	// some writers keep the jpeg APP1 prefix
+	tiff, base := exif, 0
+	if len(tiff) >= 6 && string(tiff[:6]) == "Exif\x00\x00" {
+		tiff, base = tiff[6:], 6
+	}
+	if len(tiff) < 8 {
+		return -1, nil
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return -1, nil
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return -1, nil
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return -1, nil
+	}
+
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return -1, nil
+		}
+		// orientation is a single SHORT, which is stored in the value field directly
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return base + entry + 8, order
+		}
+	}
+	return -1, nil
+}
+
+// ExifOrientation returns the orientation tag (1 ~ 8) in exif, 0 if not found or invalid
+func ExifOrientation(exif []byte) int {
+	off, order := exifOrientationOffset(exif)
+	if off < 0 {
+		return 0
+	}
+	o := int(order.Uint16(exif[off:]))
+	if o < 1 || o > 8 {
+		return 0
+	}
+	return o
+}
+
+// SetExifOrientation returns a copy of exif with the orientation tag set to o,
+// exif is returned as is if it has no orientation tag
+func SetExifOrientation(exif []byte, o int) []byte {
+	off, order := exifOrientationOffset(exif)
+	if off < 0 {
+		return exif
+	}
+	p := append([]byte{}, exif...)
+	order.PutUint16(p[off:], uint16(o))
+	return p
+}
+
+// Orient transforms img so that it displays upright according to the exif orientation,
+// the result is img itself if the orientation is 1 (normal) or invalid
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	src := toNRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		// 5 ~ 8 swap the width and height
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], row[x*4:x*4+4])
+		}
+	}
+	return dst
+}
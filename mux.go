@@ -0,0 +1,345 @@
+package gowebp
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include <webp/decode.h>
+#include <webp/mux.h>
+
+struct MuxFrame {
+	const uint8_t* data;
+	size_t size;
+	int x_offset;
+	int y_offset;
+	int duration;
+	int dispose;
+	int blend;
+} MuxFrame;
+
+WebPMux* MuxCreate(const uint8_t* data, size_t data_len) {
+	WebPData d;
+	d.bytes = data;
+	d.size = data_len;
+	return WebPMuxCreate(&d, 1);
+}
+
+int MuxNumFrames(const WebPMux* mux) {
+	int n = 0;
+	if (WebPMuxNumChunks(mux, WEBP_CHUNK_ANMF, &n) != WEBP_MUX_OK) {
+		return -1;
+	}
+	return n;
+}
+
+// frame number starts from 1, as libwebp does, the data must be freed by MuxFrameClear
+int MuxGetFrame(const WebPMux* mux, int n, struct MuxFrame* f) {
+	WebPMuxFrameInfo info;
+	WebPMuxError err = WebPMuxGetFrame(mux, (uint32_t)n, &info);
+	if (err != WEBP_MUX_OK) {
+		return err;
+	}
+	f->data = info.bitstream.bytes;
+	f->size = info.bitstream.size;
+	f->x_offset = info.x_offset;
+	f->y_offset = info.y_offset;
+	f->duration = info.duration;
+	f->dispose = (int)info.dispose_method;
+	f->blend = (int)info.blend_method;
+	return WEBP_MUX_OK;
+}
+
+void MuxFrameClear(struct MuxFrame* f) {
+	WebPData d;
+	d.bytes = f->data;
+	d.size = f->size;
+	WebPDataClear(&d);
+	f->data = NULL;
+	f->size = 0;
+}
+
+int MuxPushFrame(WebPMux* mux, const uint8_t* data, size_t data_len, int x, int y, int duration, int dispose, int blend) {
+	WebPMuxFrameInfo info;
+	memset(&info, 0, sizeof(info));
+	info.bitstream.bytes = data;
+	info.bitstream.size = data_len;
+	info.x_offset = x;
+	info.y_offset = y;
+	info.duration = duration;
+	info.id = WEBP_CHUNK_ANMF;
+	info.dispose_method = (WebPMuxAnimDispose)dispose;
+	info.blend_method = (WebPMuxAnimBlend)blend;
+	return WebPMuxPushFrame(mux, &info, 1);
+}
+
+int MuxGetChunk(const WebPMux* mux, const char* fourcc, const uint8_t** data, size_t* data_len) {
+	WebPData d;
+	WebPMuxError err = WebPMuxGetChunk(mux, fourcc, &d);
+	*data = d.bytes;
+	*data_len = d.size;
+	return err;
+}
+
+int MuxSetChunk(WebPMux* mux, const char* fourcc, const uint8_t* data, size_t data_len) {
+	WebPData d;
+	d.bytes = data;
+	d.size = data_len;
+	return WebPMuxSetChunk(mux, fourcc, &d, 1);
+}
+
+int MuxGetAnimationParams(const WebPMux* mux, uint32_t* bgcolor, int* loop_count) {
+	WebPMuxAnimParams params;
+	WebPMuxError err = WebPMuxGetAnimationParams(mux, &params);
+	*bgcolor = params.bgcolor;
+	*loop_count = params.loop_count;
+	return err;
+}
+
+int MuxSetAnimationParams(WebPMux* mux, uint32_t bgcolor, int loop_count) {
+	WebPMuxAnimParams params;
+	params.bgcolor = bgcolor;
+	params.loop_count = loop_count;
+	return WebPMuxSetAnimationParams(mux, &params);
+}
+
+int MuxAssemble(WebPMux* mux, uint8_t** output, size_t* output_len) {
+	WebPData d;
+	WebPMuxError err = WebPMuxAssemble(mux, &d);
+	*output = (uint8_t*)d.bytes;
+	*output_len = d.size;
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"time"
+	"unsafe"
+)
+
+var muxErrorText = map[C.int]string{
+	C.WEBP_MUX_NOT_FOUND:        "not found",
+	C.WEBP_MUX_INVALID_ARGUMENT: "invalid argument",
+	C.WEBP_MUX_BAD_DATA:         "bad data",
+	C.WEBP_MUX_MEMORY_ERROR:     "memory error",
+	C.WEBP_MUX_NOT_ENOUGH_DATA:  "not enough data",
+}
+
+func muxError(op string, err C.int) error {
+	if err == C.WEBP_MUX_OK {
+		return nil
+	}
+	if text, ok := muxErrorText[err]; ok {
+		return fmt.Errorf("webp mux: %s: %s", op, text)
+	}
+	return fmt.Errorf("webp mux: %s failed", op)
+}
+
+// AnimFrame is a frame of Animation, Data holds the compressed frame as a complete still webp
+// (RIFF header + ALPH + VP8/VP8L chunks), so it can be decoded by Decode and friends directly
+type AnimFrame struct {
+	X, Y     int // offset relative to the canvas, must be even
+	Duration time.Duration
+	Dispose  DisposeMethod
+	Blend    BlendMethod
+	Data     []byte
+}
+
+// Animation holds an animated webp for editing, the frames will never be re-encoded.
+// Note that dropping or reordering frames which are not keyframes may change how
+// the following frames are rendered, see FrameInfo.Keyframe
+type Animation struct {
+	Width, Height   int
+	LoopCount       int // 0 means infinite
+	BackgroundColor color.NRGBA
+	Frames          []AnimFrame
+
+	// metadata chunks, nil if not present
+	ICCP, EXIF, XMP []byte
+}
+
+// ParseAnimation parses an animated webp, still images are not accepted
+func ParseAnimation(webp []byte) (*Animation, error) {
+	if len(webp) == 0 {
+		return nil, errors.New("webp mux: empty data")
+	}
+
+	mux := C.MuxCreate((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
+	if mux == nil {
+		return nil, errors.New("webp mux: invalid data")
+	}
+	defer C.WebPMuxDelete(mux)
+
+	a := &Animation{}
+
+	var width, height C.int
+	if err := muxError("get canvas size", C.int(C.WebPMuxGetCanvasSize(mux, &width, &height))); err != nil {
+		return nil, err
+	}
+	a.Width, a.Height = int(width), int(height)
+
+	var bgcolor C.uint32_t
+	var loop C.int
+	if err := muxError("get animation params", C.MuxGetAnimationParams(mux, &bgcolor, &loop)); err != nil {
+		return nil, err
+	}
+	a.LoopCount = int(loop)
+	// stored as [blue, green, red, alpha] in the file
+	a.BackgroundColor = color.NRGBA{R: uint8(bgcolor >> 16), G: uint8(bgcolor >> 8), B: uint8(bgcolor), A: uint8(bgcolor >> 24)}
+
+	n := int(C.MuxNumFrames(mux))
+	if n < 0 {
+		return nil, errors.New("webp mux: can't count frames")
+	}
+	if n == 0 {
+		return nil, errors.New("webp mux: not an animated webp")
+	}
+
+	a.Frames = make([]AnimFrame, n)
+	for i := range a.Frames {
+		f := C.struct_MuxFrame{}
+		if err := muxError("get frame", C.MuxGetFrame(mux, C.int(i+1), &f)); err != nil {
+			return nil, err
+		}
+		a.Frames[i] = AnimFrame{
+			X:        int(f.x_offset),
+			Y:        int(f.y_offset),
+			Duration: time.Duration(f.duration) * time.Millisecond,
+			Dispose:  DisposeMethod(f.dispose),
+			Blend:    BlendMethod(f.blend),
+			Data:     C.GoBytes(unsafe.Pointer(f.data), C.int(f.size)),
+		}
+		C.MuxFrameClear(&f)
+	}
+
+	a.ICCP = muxGetChunk(mux, "ICCP")
+	a.EXIF = muxGetChunk(mux, "EXIF")
+	a.XMP = muxGetChunk(mux, "XMP ")
+	return a, nil
+}
+
+func muxGetChunk(mux *C.WebPMux, fourcc string) []byte {
+	var data *C.uint8_t
+	var size C.size_t
+
+	cs := C.CString(fourcc)
+	defer C.free(unsafe.Pointer(cs))
+
+	if C.MuxGetChunk(mux, cs, &data, &size) != C.WEBP_MUX_OK {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(data), C.int(size))
+}
+
+func muxSetChunk(mux *C.WebPMux, fourcc string, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	cs := C.CString(fourcc)
+	defer C.free(unsafe.Pointer(cs))
+
+	return muxError("set chunk "+fourcc, C.MuxSetChunk(mux, cs, (*C.uint8_t)(&p[0]), C.size_t(len(p))))
+}
+
+// addChunk adds a metadata chunk (ICCP, EXIF or XMP) into webp, the existing one will be replaced
+func addChunk(webp []byte, fourcc string, p []byte) ([]byte, error) {
+	mux := C.MuxCreate((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
+	if mux == nil {
+		return nil, errors.New("webp mux: invalid data")
+	}
+	defer C.WebPMuxDelete(mux)
+
+	if err := muxSetChunk(mux, fourcc, p); err != nil {
+		return nil, err
+	}
+	return muxAssemble(mux)
+}
+
+func muxAssemble(mux *C.WebPMux) ([]byte, error) {
+	var output *C.uint8_t
+	var size C.size_t
+	if err := muxError("assemble", C.MuxAssemble(mux, &output, &size)); err != nil {
+		return nil, err
+	}
+	defer C.WebPFree(unsafe.Pointer(output))
+
+	return C.GoBytes(unsafe.Pointer(output), C.int(size)), nil
+}
+
+// ScaleDurations multiplies the duration of each frame by factor, e.g. 2 makes the animation twice as slow
+func (a *Animation) ScaleDurations(factor float64) {
+	for i := range a.Frames {
+		ms := float64(a.Frames[i].Duration/time.Millisecond)*factor + 0.5
+		a.Frames[i].Duration = time.Duration(ms) * time.Millisecond
+	}
+}
+
+// Reorder rearranges the frames by their old indexes, frames not in order will be dropped
+// and frames appearing multiple times will be duplicated
+func (a *Animation) Reorder(order []int) error {
+	frames := make([]AnimFrame, len(order))
+	for i, n := range order {
+		if n < 0 || n >= len(a.Frames) {
+			return ErrFrameOutOfRange
+		}
+		frames[i] = a.Frames[n]
+	}
+	a.Frames = frames
+	return nil
+}
+
+// Encode assembles the animation into webp and writes it to w
+func (a *Animation) Encode(w io.Writer) error {
+	if len(a.Frames) == 0 {
+		return errors.New("webp mux: no frames")
+	}
+
+	mux := C.WebPMuxNew()
+	if mux == nil {
+		return errors.New("webp mux: memory error")
+	}
+	defer C.WebPMuxDelete(mux)
+
+	for _, f := range a.Frames {
+		if len(f.Data) == 0 {
+			return errors.New("webp mux: empty frame")
+		}
+		err := C.MuxPushFrame(mux, (*C.uint8_t)(&f.Data[0]), C.size_t(len(f.Data)),
+			C.int(f.X), C.int(f.Y), C.int(f.Duration/time.Millisecond), C.int(f.Dispose), C.int(f.Blend))
+		if err := muxError("push frame", err); err != nil {
+			return err
+		}
+	}
+
+	bg := a.BackgroundColor
+	bgcolor := uint32(bg.A)<<24 | uint32(bg.R)<<16 | uint32(bg.G)<<8 | uint32(bg.B)
+	if err := muxError("set animation params", C.MuxSetAnimationParams(mux, C.uint32_t(bgcolor), C.int(a.LoopCount))); err != nil {
+		return err
+	}
+
+	if a.Width > 0 && a.Height > 0 {
+		if err := muxError("set canvas size", C.int(C.WebPMuxSetCanvasSize(mux, C.int(a.Width), C.int(a.Height)))); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range []struct {
+		fourcc string
+		data   []byte
+	}{{"ICCP", a.ICCP}, {"EXIF", a.EXIF}, {"XMP ", a.XMP}} {
+		if err := muxSetChunk(mux, c.fourcc, c.data); err != nil {
+			return err
+		}
+	}
+
+	p, err := muxAssemble(mux)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(p)
+	return err
+}
@@ -0,0 +1,142 @@
+package gowebp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+)
+
+func encodeFill(t *testing.T, w, h int, c color.NRGBA) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, img, &EncoderOptions{Quality: 100, Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testAnimation generates a 32x32 animation: an opaque red keyframe, a half transparent blue
+// square at (8, 8) which is disposed to the background, then an opaque green square at (0, 0)
+func testAnimation(t *testing.T) *Animation {
+	return &Animation{
+		Width:     32,
+		Height:    32,
+		LoopCount: 3,
+		EXIF:      []byte("Exif\x00\x00fake"),
+		Frames: []AnimFrame{
+			{Duration: 100 * time.Millisecond, Data: encodeFill(t, 32, 32, color.NRGBA{255, 0, 0, 255})},
+			{X: 8, Y: 8, Duration: 200 * time.Millisecond, Dispose: DisposeBackground, Blend: BlendAlpha,
+				Data: encodeFill(t, 16, 16, color.NRGBA{0, 0, 255, 128})},
+			{Duration: 300 * time.Millisecond, Blend: BlendAlpha, Data: encodeFill(t, 16, 16, color.NRGBA{0, 255, 0, 255})},
+		},
+	}
+}
+
+func encodeAnimation(t *testing.T, a *Animation) []byte {
+	buf := &bytes.Buffer{}
+	if err := a.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimationRoundTrip(t *testing.T) {
+	src := testAnimation(t)
+	src.BackgroundColor = color.NRGBA{R: 1, G: 2, B: 3, A: 4}
+	a, err := ParseAnimation(encodeAnimation(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Width != 32 || a.Height != 32 || a.LoopCount != 3 || a.BackgroundColor != src.BackgroundColor {
+		t.Fatal("unexpected animation:", a.Width, a.Height, a.LoopCount, a.BackgroundColor)
+	}
+	if string(a.EXIF) != string(src.EXIF) || a.ICCP != nil || a.XMP != nil {
+		t.Fatal("unexpected metadata:", a.EXIF, a.ICCP, a.XMP)
+	}
+	if len(a.Frames) != 3 {
+		t.Fatal("unexpected frames:", len(a.Frames))
+	}
+	for i, f := range a.Frames {
+		s := src.Frames[i]
+		if f.X != s.X || f.Y != s.Y || f.Duration != s.Duration || f.Dispose != s.Dispose || f.Blend != s.Blend {
+			t.Fatal(i, "unexpected frame:", f.X, f.Y, f.Duration, f.Dispose, f.Blend)
+		}
+		// frames are complete webp files
+		if string(f.Data[:4]) != "RIFF" || !IsWebPFormat(f.Data) {
+			t.Fatal(i, "not a webp")
+		}
+		b := Decode(f.Data).Bounds()
+		if w, h := b.Dx(), b.Dy(); w != map[bool]int{true: 32, false: 16}[i == 0] || w != h {
+			t.Fatal(i, "unexpected size:", w, h)
+		}
+	}
+
+	// frames are never re-encoded
+	again, err := ParseAnimation(encodeAnimation(t, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range a.Frames {
+		if !bytes.Equal(a.Frames[i].Data, again.Frames[i].Data) {
+			t.Fatal(i, "frame data changed")
+		}
+	}
+}
+
+func TestParseAnimationInvalid(t *testing.T) {
+	if _, err := ParseAnimation(nil); err == nil {
+		t.Error("expect an error")
+	}
+	// still images are not animations
+	if _, err := ParseAnimation(encodeFill(t, 8, 8, color.NRGBA{A: 255})); err == nil {
+		t.Error("expect an error")
+	}
+}
+
+func TestAnimationReorder(t *testing.T) {
+	a := testAnimation(t)
+	frames := a.Frames
+
+	if err := a.Reorder([]int{2, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 3 || a.Frames[0].Duration != frames[2].Duration || a.Frames[2].Duration != frames[0].Duration {
+		t.Fatal("unexpected order")
+	}
+
+	for _, order := range [][]int{{0, 3}, {-1}} {
+		if err := a.Reorder(order); err != ErrFrameOutOfRange {
+			t.Fatal(order, "expect ErrFrameOutOfRange, got", err)
+		}
+		if len(a.Frames) != 3 || a.Frames[0].Duration != frames[2].Duration {
+			t.Fatal(order, "frames changed by a failed reorder")
+		}
+	}
+
+	if err := a.Reorder([]int{1}); err != nil || len(a.Frames) != 1 || a.Frames[0].Duration != frames[0].Duration {
+		t.Fatal("unexpected frames:", err, len(a.Frames))
+	}
+}
+
+func TestAnimationScaleDurations(t *testing.T) {
+	a := testAnimation(t)
+	a.Frames[0].Duration = 33 * time.Millisecond
+
+	a.ScaleDurations(1.5)
+	for i, want := range []time.Duration{50, 300, 450} {
+		if a.Frames[i].Duration != want*time.Millisecond {
+			t.Fatal(i, "unexpected duration:", a.Frames[i].Duration)
+		}
+	}
+
+	a.ScaleDurations(0.5)
+	if d := a.Frames[0].Duration; d != 25*time.Millisecond {
+		t.Fatal("unexpected duration:", d)
+	}
+}
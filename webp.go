@@ -2,7 +2,7 @@ package gowebp
 
 /*
 #cgo CFLAGS: -I./libwebp-1.0.0/src
-#cgo LDFLAGS: -L./libwebp-1.0.0/src -l webp -l m
+#cgo LDFLAGS: -L./libwebp-1.0.0/src -L./libwebp-1.0.0/src/demux -L./libwebp-1.0.0/src/mux -l webpmux -l webpdemux -l webp -l m
 #include <stdlib.h>
 #include <string.h>
 #include <webp/encode.h>
@@ -14,6 +14,7 @@ struct Result {
 	uint64_t len;
 	uint64_t width;
 	uint64_t height;
+	uint64_t status;
 } Result;
 
 struct ResultYUV {
@@ -24,6 +25,8 @@ struct ResultYUV {
 	uint64_t height;
 	uint64_t stride;
 	uint64_t uv_stride;
+	uint8_t  *a;
+	uint64_t a_stride;
 } ResultYUV;
 
 struct Result* Encode(const uint8_t* rgba, int width, int height, int stride, float qf) {
@@ -32,6 +35,112 @@ struct Result* Encode(const uint8_t* rgba, int width, int height, int stride, fl
 	return ret;
 }
 
+struct EncodeOptions {
+	float quality;
+	int   lossless;
+	int   method;
+	int   alpha_compression;
+	int   alpha_filtering;
+	int   alpha_quality;
+	int   use_sharp_yuv;
+	int   exact;
+} EncodeOptions;
+
+// layout: 0 = RGB, 1 = BGR, 2 = RGBA, 3 = BGRA, 4 = RGBX, 5 = BGRX
+int ImportPicture(WebPPicture* pic, const uint8_t* pix, int layout, int stride) {
+	switch (layout) {
+	case 0: return WebPPictureImportRGB(pic, pix, stride);
+	case 1: return WebPPictureImportBGR(pic, pix, stride);
+	case 2: return WebPPictureImportRGBA(pic, pix, stride);
+	case 3: return WebPPictureImportBGRA(pic, pix, stride);
+	case 4: return WebPPictureImportRGBX(pic, pix, stride);
+	case 5: return WebPPictureImportBGRX(pic, pix, stride);
+	}
+	return 0;
+}
+
+struct Result* EncodeAdvanced(const uint8_t* pix, int layout, int width, int height, int stride, const struct EncodeOptions* opt) {
+	struct Result* ret = malloc(sizeof(struct Result));
+	WebPConfig config;
+	WebPPicture pic;
+	WebPMemoryWriter wr;
+
+	ret->output = NULL;
+	ret->len = 0;
+	ret->width = (uint64_t)width;
+	ret->height = (uint64_t)height;
+
+	if (!WebPConfigInit(&config) || !WebPPictureInit(&pic)) {
+		return ret;
+	}
+
+	config.quality = opt->quality;
+	config.lossless = opt->lossless;
+	config.method = opt->method;
+	config.alpha_compression = opt->alpha_compression;
+	config.alpha_filtering = opt->alpha_filtering;
+	config.alpha_quality = opt->alpha_quality;
+	config.use_sharp_yuv = opt->use_sharp_yuv;
+	config.exact = opt->exact;
+	if (!WebPValidateConfig(&config)) {
+		return ret;
+	}
+
+	pic.width = width;
+	pic.height = height;
+	// importing into yuv directly would skip the sharp conversion, so keep argb
+	// and let WebPEncode do the conversion (WebPPictureSharpARGBToYUVA)
+	pic.use_argb = config.lossless || config.use_sharp_yuv;
+	if (!ImportPicture(&pic, pix, layout, stride)) {
+		WebPPictureFree(&pic);
+		return ret;
+	}
+
+	WebPMemoryWriterInit(&wr);
+	pic.writer = WebPMemoryWrite;
+	pic.custom_ptr = &wr;
+	if (WebPEncode(&config, &pic)) {
+		ret->output = wr.mem;
+		ret->len = (uint64_t)wr.size;
+	} else {
+		WebPMemoryWriterClear(&wr);
+	}
+	WebPPictureFree(&pic);
+	return ret;
+}
+
+// blend rgba against the background (0xRRGGBB) in place, the result is fully opaque
+int BlendRGBA(uint8_t* rgba, int width, int height, int stride, uint32_t background) {
+	WebPPicture pic;
+	int x, y;
+
+	if (!WebPPictureInit(&pic)) {
+		return 0;
+	}
+	pic.width = width;
+	pic.height = height;
+	pic.use_argb = 1;
+	if (!WebPPictureImportRGBA(&pic, rgba, stride)) {
+		WebPPictureFree(&pic);
+		return 0;
+	}
+
+	WebPBlendAlpha(&pic, background);
+
+	for (y = 0; y < height; y++) {
+		const uint32_t* argb = pic.argb + y * pic.argb_stride;
+		uint8_t* row = rgba + y * stride;
+		for (x = 0; x < width; x++) {
+			row[x * 4 + 0] = (argb[x] >> 16) & 0xff;
+			row[x * 4 + 1] = (argb[x] >> 8) & 0xff;
+			row[x * 4 + 2] = argb[x] & 0xff;
+			row[x * 4 + 3] = 0xff;
+		}
+	}
+	WebPPictureFree(&pic);
+	return 1;
+}
+
 struct Result* Decode(const uint8_t* data, size_t data_len) {
 	struct Result* ret = malloc(sizeof(struct Result));
 	int width, height;
@@ -42,6 +151,49 @@ struct Result* Decode(const uint8_t* data, size_t data_len) {
 	return ret;
 }
 
+struct DecodeOptions {
+	int dithering_strength;
+	int alpha_dithering_strength;
+	int colorspace;
+	int scaled_width;
+	int scaled_height;
+} DecodeOptions;
+
+struct Result* DecodeAdvanced(const uint8_t* data, size_t data_len, const struct DecodeOptions* opt) {
+	struct Result* ret = malloc(sizeof(struct Result));
+	WebPDecoderConfig config;
+
+	ret->output = NULL;
+	ret->len = 0;
+	ret->status = VP8_STATUS_INVALID_PARAM;
+	if (!WebPInitDecoderConfig(&config)) {
+		return ret;
+	}
+
+	config.options.dithering_strength = opt->dithering_strength;
+	config.options.alpha_dithering_strength = opt->alpha_dithering_strength;
+	config.output.colorspace = (WEBP_CSP_MODE)opt->colorspace;
+	if (opt->scaled_width > 0 || opt->scaled_height > 0) {
+		// a zero dimension will be computed from the other one by libwebp
+		config.options.use_scaling = 1;
+		config.options.scaled_width = opt->scaled_width;
+		config.options.scaled_height = opt->scaled_height;
+	}
+
+	ret->status = WebPDecode(data, data_len, &config);
+	if (ret->status != VP8_STATUS_OK) {
+		WebPFreeDecBuffer(&config.output);
+		return ret;
+	}
+
+	// the buffer is owned by the decoder, so it can be released by WebPFree later
+	ret->output = config.output.u.RGBA.rgba;
+	ret->len = (uint64_t)config.output.u.RGBA.size;
+	ret->width = (uint64_t)config.output.width;
+	ret->height = (uint64_t)config.output.height;
+	return ret;
+}
+
 struct ResultYUV* DecodeYUV(const uint8_t* data, size_t data_len) {
 	struct ResultYUV* ret = malloc(sizeof(struct ResultYUV));
 	int width, height, stride, uv_stride;
@@ -53,6 +205,39 @@ struct ResultYUV* DecodeYUV(const uint8_t* data, size_t data_len) {
 	return ret;
 }
 
+// decode into yuv 4:2:0 with the alpha plane (if any), a is NULL if the image has no alpha
+struct ResultYUV* DecodeYUVA(const uint8_t* data, size_t data_len) {
+	struct ResultYUV* ret = malloc(sizeof(struct ResultYUV));
+	WebPDecoderConfig config;
+	const WebPYUVABuffer* buf = &config.output.u.YUVA;
+
+	memset(ret, 0, sizeof(struct ResultYUV));
+	if (!WebPInitDecoderConfig(&config)) {
+		return ret;
+	}
+	if (WebPGetFeatures(data, data_len, &config.input) != VP8_STATUS_OK) {
+		return ret;
+	}
+
+	config.output.colorspace = config.input.has_alpha ? MODE_YUVA : MODE_YUV;
+	if (WebPDecode(data, data_len, &config) != VP8_STATUS_OK) {
+		WebPFreeDecBuffer(&config.output);
+		return ret;
+	}
+
+	// y is the start of the buffer owned by the decoder, so it can be released by WebPFree later
+	ret->output = buf->y;
+	ret->u = buf->u;
+	ret->v = buf->v;
+	ret->a = buf->a;
+	ret->width = (uint64_t)config.output.width;
+	ret->height = (uint64_t)config.output.height;
+	ret->stride = (uint64_t)buf->y_stride;
+	ret->uv_stride = (uint64_t)buf->u_stride;
+	ret->a_stride = (uint64_t)buf->a_stride;
+	return ret;
+}
+
 void Free(struct Result* r) {
 	WebPFree(r->output);
 	free(r);
@@ -67,6 +252,18 @@ int IsWebp(const uint8_t* data, size_t data_size) {
 	return WebPGetInfo(data, data_size, NULL, NULL);
 }
 
+int GetInfo(const uint8_t* data, size_t data_size, int* width, int* height) {
+	return WebPGetInfo(data, data_size, width, height);
+}
+
+int HasAlpha(const uint8_t* data, size_t data_size) {
+	WebPBitstreamFeatures features;
+	if (WebPGetFeatures(data, data_size, &features) != VP8_STATUS_OK) {
+		return 0;
+	}
+	return features.has_alpha;
+}
+
 */
 import "C"
 
@@ -74,6 +271,7 @@ import (
 	"bytes"
 	"errors"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/jpeg"
 	"io"
@@ -85,12 +283,25 @@ type result struct {
 	output        uintptr
 	len           uint64
 	width, height uint64
+	status        uint64
 }
 
 type resultyuv struct {
 	output, u, v     uintptr
 	width, height    uint64
 	stride, uvstride uint64
+	a                uintptr
+	astride          uint64
+}
+
+// plane returns the plane of h rows starting at data, the last row may be shorter than stride
+func (r *resultyuv) plane(data uintptr, stride, w, h uint64) []byte {
+	n := int(stride*(h-1) + w)
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Data: data,
+		Len:  n,
+		Cap:  n,
+	}))
 }
 
 // EncodeLossy encodes img into webp and writes it to w
@@ -123,6 +334,190 @@ func EncodeLossy(w io.Writer, img image.Image, quality int) bool {
 	return true
 }
 
+// EncoderOptions holds the advanced encoder settings, see WebPConfig in encode.h
+type EncoderOptions struct {
+	Quality  float32 // 0 (smallest) ~ 100 (biggest)
+	Lossless bool
+	Method   int // 0 (fast) ~ 6 (slower but better)
+
+	AlphaCompression int // 0: none, 1: compressed with webp lossless
+	AlphaFiltering   int // 0: none, 1: fast, 2: best
+	AlphaQuality     int // 0 (smallest) ~ 100 (lossless)
+
+	// UseSharpYUV uses the sharp (and slow) RGB->YUV conversion in lossy mode,
+	// which reduces color bleeding around saturated edges
+	UseSharpYUV bool
+
+	// Exact keeps the RGB values under fully transparent pixels, which are altered
+	// for better compression otherwise
+	Exact bool
+
+	// EXIF will be embedded into the output if not empty, e.g. ReadChunk(webp, "EXIF")
+	EXIF []byte
+	// ResetOrientation sets the orientation tag in EXIF to 1 (normal) before embedding,
+	// so images oriented by DecoderOptions.AutoOrient won't be rotated twice
+	ResetOrientation bool
+}
+
+// DefaultEncoderOptions returns the libwebp default settings with the given quality
+func DefaultEncoderOptions(quality float32) *EncoderOptions {
+	return &EncoderOptions{
+		Quality:          quality,
+		Method:           4,
+		AlphaCompression: 1,
+		AlphaFiltering:   1,
+		AlphaQuality:     100,
+	}
+}
+
+func (o *EncoderOptions) c() C.struct_EncodeOptions {
+	opt := C.struct_EncodeOptions{
+		quality:           C.float(o.Quality),
+		method:            C.int(o.Method),
+		alpha_compression: C.int(o.AlphaCompression),
+		alpha_filtering:   C.int(o.AlphaFiltering),
+		alpha_quality:     C.int(o.AlphaQuality),
+	}
+	if o.Lossless {
+		opt.lossless = 1
+	}
+	if o.UseSharpYUV {
+		opt.use_sharp_yuv = 1
+	}
+	if o.Exact {
+		opt.exact = 1
+	}
+	return opt
+}
+
+// toNRGBA returns img as image.NRGBA, libwebp expects non-premultiplied samples
+func toNRGBA(img image.Image) *image.NRGBA {
+	if p, ok := img.(*image.NRGBA); ok {
+		return p
+	}
+	canvas := image.NewNRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+	return canvas
+}
+
+// Encode encodes img into webp with the given options and writes it to w,
+// nil opts means DefaultEncoderOptions(75)
+func Encode(w io.Writer, img image.Image, opts *EncoderOptions) error {
+	if opts == nil {
+		opts = DefaultEncoderOptions(75)
+	}
+
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return errors.New("webp encode: empty image")
+	}
+
+	p := toNRGBA(img)
+	return encodeRaw(w, p.Pix, LayoutRGBA, width, height, p.Stride, opts)
+}
+
+// PixelLayout is the order of samples in a raw pixel buffer
+type PixelLayout int
+
+const (
+	LayoutRGB  PixelLayout = iota // R, G, B, R, G, B, ...
+	LayoutBGR                     // B, G, R, B, G, R, ...
+	LayoutRGBA                    // R, G, B, A, ..., non-premultiplied
+	LayoutBGRA                    // B, G, R, A, ..., non-premultiplied
+	LayoutRGBX                    // R, G, B, ignored, ...
+	LayoutBGRX                    // B, G, R, ignored, ...
+)
+
+// BytesPerPixel returns the size of a pixel in the layout
+func (l PixelLayout) BytesPerPixel() int {
+	if l == LayoutRGB || l == LayoutBGR {
+		return 3
+	}
+	return 4
+}
+
+// EncodeRaw encodes a raw pixel buffer into webp without wrapping it in image.Image,
+// nil opts means DefaultEncoderOptions(75). This is the same as WebPEncodeRGB/BGR/BGRA if opts
+// only sets Quality, and WebPEncodeLossless* if opts only sets Lossless and Exact
+func EncodeRaw(pix []byte, layout PixelLayout, width, height, stride int, opts *EncoderOptions) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encodeRaw(buf, pix, layout, width, height, stride, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeRaw(w io.Writer, pix []byte, layout PixelLayout, width, height, stride int, opts *EncoderOptions) error {
+	if opts == nil {
+		opts = DefaultEncoderOptions(75)
+	}
+	if layout < LayoutRGB || layout > LayoutBGRX {
+		return errors.New("webp encode: unknown pixel layout")
+	}
+	if width <= 0 || height <= 0 {
+		return errors.New("webp encode: empty image")
+	}
+	if stride < width*layout.BytesPerPixel() || len(pix) < stride*(height-1)+width*layout.BytesPerPixel() {
+		return errors.New("webp encode: pixel buffer too small")
+	}
+
+	opt := opts.c()
+	x := C.EncodeAdvanced((*C.uint8_t)(&pix[0]), C.int(layout), C.int(width), C.int(height), C.int(stride), &opt)
+	r := (*result)(unsafe.Pointer(x))
+
+	if r.output == 0 {
+		C.Free(x)
+		return errors.New("webp encode failed")
+	}
+
+	src := reflect.SliceHeader{}
+	src.Data = r.output
+	src.Len = int(r.len)
+	src.Cap = int(r.len)
+	output := *(*[]byte)(unsafe.Pointer(&src))
+	defer C.Free(x)
+
+	if len(opts.EXIF) > 0 {
+		exif := opts.EXIF
+		if opts.ResetOrientation {
+			exif = SetExifOrientation(exif, 1)
+		}
+		var err error
+		if output, err = addChunk(output, "EXIF", exif); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(output)
+	return err
+}
+
+// FlattenAlpha blends img against the background color and returns an opaque image.RGBA,
+// it is useful when the output can't carry transparency
+func FlattenAlpha(img image.Image, background color.Color) (*image.RGBA, error) {
+	src := toNRGBA(img)
+	p := image.NewNRGBA(src.Bounds())
+	width, height := p.Rect.Dx(), p.Rect.Dy()
+	for y := 0; y < height; y++ {
+		copy(p.Pix[y*p.Stride:y*p.Stride+width*4], src.Pix[y*src.Stride:])
+	}
+
+	if len(p.Pix) > 0 {
+		if C.BlendRGBA((*C.uint8_t)(&p.Pix[0]), C.int(width), C.int(height), C.int(p.Stride), rgb24(background)) == 0 {
+			return nil, errors.New("webp blend failed")
+		}
+	}
+
+	// all pixels are opaque now, so premultiplied and non-premultiplied are the same
+	return &image.RGBA{Pix: p.Pix, Stride: p.Stride, Rect: p.Rect}, nil
+}
+
+func rgb24(c color.Color) C.uint32_t {
+	r, g, b, _ := c.RGBA()
+	return C.uint32_t((r>>8)<<16 | (g>>8)<<8 | b>>8)
+}
+
 // Decode decodes webp into image.RGBA
 func Decode(webp []byte) image.Image {
 	x := C.Decode((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
@@ -142,39 +537,239 @@ func Decode(webp []byte) image.Image {
 	return nil
 }
 
-// DecodeYCbCr decodes webp into image.YCbCr
-func DecodeYCbCr(webp []byte) image.Image {
-	x := C.DecodeYUV((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
-	r := (*resultyuv)(unsafe.Pointer(x))
-	if r.output != 0 {
-		src := reflect.SliceHeader{}
-		src.Data = r.output
-		src.Len = int(r.width * r.height)
-		src.Cap = src.Len
+// DecoderOptions holds the advanced decoder settings, see WebPDecoderOptions in decode.h
+type DecoderOptions struct {
+	// DitheringStrength: 0 (off) ~ 100 (full), only applies to lossy images,
+	// it trades a little noise for smoother gradients. Note that libwebp only dithers
+	// the chroma planes of segments with a fine enough quantizer (roughly quality >= 90)
+	DitheringStrength int
+	// AlphaDitheringStrength: 0 (off) ~ 100 (full), smooths the quantized alpha plane
+	AlphaDitheringStrength int
+	// AutoOrient rotates or mirrors the decoded image according to the orientation tag in
+	// the EXIF chunk, only DecodeWithOptions honors it
+	AutoOrient bool
+	// ScaledWidth and ScaledHeight resize the image while decoding, which is much cheaper
+	// than scaling the decoded image. If one of them is 0 it will be computed from the other
+	// to keep the aspect ratio, both 0 means no scaling. The size applies before AutoOrient
+	ScaledWidth, ScaledHeight int
+}
+
+var statusText = [...]string{
+	"ok", "out of memory", "invalid param", "bitstream error",
+	"unsupported feature", "suspended", "user abort", "not enough data",
+}
+
+func statusError(status uint64) error {
+	if status < uint64(len(statusText)) {
+		return errors.New("webp decode: " + statusText[status])
+	}
+	return errors.New("webp decode failed")
+}
+
+// DecodeWithOptions decodes webp into image.NRGBA with the given options, nil opts means no dithering
+func DecodeWithOptions(webp []byte, opts *DecoderOptions) (image.Image, error) {
+	if len(webp) == 0 {
+		return nil, statusError(C.VP8_STATUS_NOT_ENOUGH_DATA)
+	}
+	img, err := decodeNRGBA((*C.uint8_t)(&webp[0]), C.size_t(len(webp)), opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.AutoOrient {
+		return Orient(img, ExifOrientation(ReadChunk(webp, "EXIF"))), nil
+	}
+	return img, nil
+}
+
+// ColorMode is the output colorspace of DecodeRaw, see WEBP_CSP_MODE in decode.h
+type ColorMode int
+
+const (
+	ModeRGB            ColorMode = C.MODE_RGB
+	ModeRGBA           ColorMode = C.MODE_RGBA
+	ModeBGR            ColorMode = C.MODE_BGR
+	ModeBGRA           ColorMode = C.MODE_BGRA
+	ModeARGB           ColorMode = C.MODE_ARGB
+	ModeRGBA4444       ColorMode = C.MODE_RGBA_4444
+	ModeRGB565         ColorMode = C.MODE_RGB_565
+	ModePremulRGBA     ColorMode = C.MODE_rgbA
+	ModePremulBGRA     ColorMode = C.MODE_bgrA
+	ModePremulARGB     ColorMode = C.MODE_Argb
+	ModePremulRGBA4444 ColorMode = C.MODE_rgbA_4444
+)
+
+// BytesPerPixel returns the size of a pixel in the mode
+func (m ColorMode) BytesPerPixel() int {
+	switch m {
+	case ModeRGB, ModeBGR:
+		return 3
+	case ModeRGBA4444, ModeRGB565, ModePremulRGBA4444:
+		return 2
+	}
+	return 4
+}
+
+// DecodeRaw decodes webp into a tightly packed pixel buffer in the given mode,
+// the stride of the buffer is width * mode.BytesPerPixel()
+func DecodeRaw(webp []byte, mode ColorMode, opts *DecoderOptions) (pix []byte, width, height int, err error) {
+	if len(webp) == 0 {
+		return nil, 0, 0, statusError(C.VP8_STATUS_NOT_ENOUGH_DATA)
+	}
+	if mode < ModeRGB || mode > ModePremulRGBA4444 {
+		return nil, 0, 0, statusError(C.VP8_STATUS_INVALID_PARAM)
+	}
+
+	x, err := decodeAdvanced((*C.uint8_t)(&webp[0]), C.size_t(len(webp)), mode, opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	r := (*result)(unsafe.Pointer(x))
+	src := reflect.SliceHeader{}
+	src.Data = r.output
+	src.Len = int(r.len)
+	src.Cap = int(r.len)
+
+	pix = make([]byte, r.len)
+	copy(pix, *(*[]byte)(unsafe.Pointer(&src)))
+	width, height = int(r.width), int(r.height)
+	C.Free(x)
+	return pix, width, height, nil
+}
+
+// decodeAdvanced decodes webp data located either in Go or C memory,
+// the result must be released by C.Free
+func decodeAdvanced(data *C.uint8_t, size C.size_t, mode ColorMode, opts *DecoderOptions) (*C.struct_Result, error) {
+	if opts == nil {
+		opts = &DecoderOptions{}
+	}
 
-		yuv := image.NewYCbCr(image.Rect(0, 0, int(r.width), int(r.height)), image.YCbCrSubsampleRatio420)
+	opt := C.struct_DecodeOptions{
+		dithering_strength:       C.int(opts.DitheringStrength),
+		alpha_dithering_strength: C.int(opts.AlphaDitheringStrength),
+		colorspace:               C.int(mode),
+		scaled_width:             C.int(opts.ScaledWidth),
+		scaled_height:            C.int(opts.ScaledHeight),
+	}
+	x := C.DecodeAdvanced(data, size, &opt)
+	r := (*result)(unsafe.Pointer(x))
+	if r.output == 0 {
+		err := statusError(r.status)
+		C.Free(x)
+		return nil, err
+	}
+	return x, nil
+}
 
-		copy(yuv.Y, *(*[]byte)(unsafe.Pointer(&src)))
+func decodeNRGBA(data *C.uint8_t, size C.size_t, opts *DecoderOptions) (*image.NRGBA, error) {
+	x, err := decodeAdvanced(data, size, ModeRGBA, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := (*result)(unsafe.Pointer(x))
+	src := reflect.SliceHeader{}
+	src.Data = r.output
+	src.Len = int(r.len)
+	src.Cap = int(r.len)
 
-		src.Data = r.v
-		src.Len = int((r.width + 1) / 2 * (r.height + 1) / 2)
-		src.Cap = src.Len
-		copy(yuv.Cr, *(*[]byte)(unsafe.Pointer(&src)))
+	img := image.NewNRGBA(image.Rect(0, 0, int(r.width), int(r.height)))
+	copy(img.Pix, *(*[]byte)(unsafe.Pointer(&src)))
+	C.Free(x)
+	return img, nil
+}
 
-		src.Data = r.u
-		copy(yuv.Cb, *(*[]byte)(unsafe.Pointer(&src)))
+// DecodeYCbCr decodes webp into image.YCbCr, or image.NYCbCrA if the webp has alpha
+func DecodeYCbCr(webp []byte) image.Image {
+	if len(webp) == 0 {
+		return nil
+	}
 
+	x := C.DecodeYUVA((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
+	r := (*resultyuv)(unsafe.Pointer(x))
+	if r.output == 0 {
 		C.FreeYUV(x)
-		return yuv
+		return nil
 	}
+
+	w, h := r.width, r.height
+	cw, ch := (w+1)/2, (h+1)/2
+	rect := image.Rect(0, 0, int(w), int(h))
+
+	var img image.Image
+	var yuv *image.YCbCr
+	if r.a != 0 {
+		nyuva := image.NewNYCbCrA(rect, image.YCbCrSubsampleRatio420)
+		copyPlane(nyuva.A, nyuva.AStride, r.plane(r.a, r.astride, w, h), int(r.astride), int(w), int(h))
+		img, yuv = nyuva, &nyuva.YCbCr
+	} else {
+		yuv = image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+		img = yuv
+	}
+
+	copyPlane(yuv.Y, yuv.YStride, r.plane(r.output, r.stride, w, h), int(r.stride), int(w), int(h))
+	copyPlane(yuv.Cb, yuv.CStride, r.plane(r.u, r.uvstride, cw, ch), int(r.uvstride), int(cw), int(ch))
+	copyPlane(yuv.Cr, yuv.CStride, r.plane(r.v, r.uvstride, cw, ch), int(r.uvstride), int(cw), int(ch))
+
 	C.FreeYUV(x)
-	return nil
+	return img
+}
+
+func copyPlane(dst []byte, dstStride int, src []byte, srcStride int, w, h int) {
+	for y := 0; y < h; y++ {
+		copy(dst[y*dstStride:y*dstStride+w], src[y*srcStride:y*srcStride+w])
+	}
 }
 
 func IsWebPFormat(p []byte) bool {
 	return int(C.IsWebp((*C.uint8_t)(&p[0]), C.size_t(len(p)))) == 1
 }
 
+func webpSize(p []byte) (width, height int) {
+	var w, h C.int
+	if C.GetInfo((*C.uint8_t)(&p[0]), C.size_t(len(p)), &w, &h) == 0 {
+		return 0, 0
+	}
+	return int(w), int(h)
+}
+
+func hasAlpha(p []byte) bool {
+	return int(C.HasAlpha((*C.uint8_t)(&p[0]), C.size_t(len(p)))) == 1
+}
+
+// DecodeToJPEGBackground works like DecodeToJPEG, but webp with alpha will be
+// blended against the background color first instead of dropping the alpha plane,
+// nil background falls back to DecodeToJPEG
+func DecodeToJPEGBackground(w io.Writer, webp []byte, options *jpeg.Options, background color.Color) error {
+	if background == nil || !hasAlpha(webp) {
+		return DecodeToJPEG(w, webp, options)
+	}
+
+	x := C.Decode((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
+	r := (*result)(unsafe.Pointer(x))
+	if r.output == 0 {
+		C.Free(x)
+		return errors.New("webp decode failed")
+	}
+
+	src := reflect.SliceHeader{}
+	src.Data = r.output
+	src.Len = int(r.len)
+	src.Cap = int(r.len)
+
+	width, height := int(r.width), int(r.height)
+	img := &image.RGBA{
+		Pix:    *(*[]byte)(unsafe.Pointer(&src)),
+		Stride: width * 4,
+		Rect:   image.Rect(0, 0, width, height),
+	}
+	defer C.Free(x)
+	if C.BlendRGBA((*C.uint8_t)(&img.Pix[0]), C.int(width), C.int(height), C.int(img.Stride), rgb24(background)) == 0 {
+		return errors.New("webp blend failed")
+	}
+	return jpeg.Encode(w, img, options)
+}
+
 // DecodeToJPEG is a more efficient way to decode webp into jpeg and directly write it into w
 func DecodeToJPEG(w io.Writer, webp []byte, options *jpeg.Options) error {
 	x := C.DecodeYUV((*C.uint8_t)(&webp[0]), C.size_t(len(webp)))
@@ -182,22 +777,15 @@ func DecodeToJPEG(w io.Writer, webp []byte, options *jpeg.Options) error {
 	if r.output != 0 {
 		yuv := &image.YCbCr{
 			SubsampleRatio: image.YCbCrSubsampleRatio420,
-			YStride:        int(r.width),
-			CStride:        int((r.width + 1) / 2),
+			YStride:        int(r.stride),
+			CStride:        int(r.uvstride),
 			Rect:           image.Rect(0, 0, int(r.width), int(r.height)),
 		}
 
-		uintptrSlice := func(data uintptr, len int) []byte {
-			return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
-				Data: data,
-				Len:  len,
-				Cap:  len,
-			}))
-		}
-
-		yuv.Y = uintptrSlice(r.output, int(r.width*r.height))
-		yuv.Cb = uintptrSlice(r.u, int((r.width+1)/2*(r.height+1)/2))
-		yuv.Cr = uintptrSlice(r.v, int((r.width+1)/2*(r.height+1)/2))
+		cw, ch := (r.width+1)/2, (r.height+1)/2
+		yuv.Y = r.plane(r.output, r.stride, r.width, r.height)
+		yuv.Cb = r.plane(r.u, r.uvstride, cw, ch)
+		yuv.Cr = r.plane(r.v, r.uvstride, cw, ch)
 
 		err := jpeg.Encode(w, yuv, options)
 
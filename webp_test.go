@@ -0,0 +1,620 @@
+package gowebp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func readFixture(t *testing.T, name string) []byte {
+	buf, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// compareGolden compares img with testdata/name, or rewrites it with -update
+func compareGolden(t *testing.T, img image.Image, name string) {
+	path := "testdata/" + name
+	if *update {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds() != golden.Bounds() {
+		t.Fatal(name, "size not matched", img.Bounds(), golden.Bounds())
+	}
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r1, g1, b1, a1 := img.At(x, y).RGBA()
+			r2, g2, b2, a2 := golden.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				t.Fatal(name, "pixel not matched at", x, y)
+			}
+		}
+	}
+}
+
+func readPNGFixture(t *testing.T, name string) image.Image {
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// psnr calculates the PSNR of the RGB channels between two images of the same size
+func psnr(a, b image.Image) float64 {
+	var mse float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				mse += d * d
+			}
+		}
+	}
+
+	mse /= float64(bounds.Dx() * bounds.Dy() * 3)
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// distinctSteps counts the horizontal neighbours with different values in channel c,
+// a banded gradient has long flat runs, so dithering should increase this number
+func distinctSteps(img image.Image, c int) int {
+	p := img.(*image.NRGBA)
+	n := 0
+	for y := 0; y < p.Rect.Dy(); y++ {
+		row := p.Pix[y*p.Stride:]
+		for x := 1; x < p.Rect.Dx(); x++ {
+			if row[x*4+c] != row[(x-1)*4+c] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestDecodeDithering(t *testing.T) {
+	webp := readFixture(t, "gradient.webp")
+
+	plain, err := DecodeWithOptions(webp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dithered, err := DecodeWithOptions(webp, &DecoderOptions{DitheringStrength: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := distinctSteps(plain, 2), distinctSteps(dithered, 2); a >= b {
+		t.Error("dithering doesn't break the bands:", a, b)
+	}
+
+	compareGolden(t, plain, "gradient.png")
+	compareGolden(t, dithered, "gradient_dither100.png")
+}
+
+func TestDecodeAlphaDithering(t *testing.T) {
+	webp := readFixture(t, "alpha_gradient.webp")
+
+	plain, err := DecodeWithOptions(webp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dithered, err := DecodeWithOptions(webp, &DecoderOptions{AlphaDitheringStrength: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := distinctSteps(plain, 3), distinctSteps(dithered, 3); a >= b {
+		t.Error("alpha dithering doesn't break the bands:", a, b)
+	}
+
+	compareGolden(t, plain, "alpha_gradient.png")
+	compareGolden(t, dithered, "alpha_gradient_dither100.png")
+}
+
+func TestDecodeWithOptionsInvalid(t *testing.T) {
+	if _, err := DecodeWithOptions([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), nil); err == nil {
+		t.Error("expect an error")
+	}
+	if _, err := DecodeWithOptions(nil, nil); err == nil {
+		t.Error("expect an error")
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	webp := readFixture(t, "gradient.webp")
+	w, h := webpSize(webp)
+
+	for _, c := range []struct{ sw, sh, ew, eh int }{
+		{w / 2, h / 4, w / 2, h / 4},
+		{w / 4, 0, w / 4, (h*(w/4) + w/2) / w},
+		{0, h / 2, (w*(h/2) + h/2) / h, h / 2},
+		{0, 0, w, h},
+	} {
+		img, err := DecodeWithOptions(webp, &DecoderOptions{ScaledWidth: c.sw, ScaledHeight: c.sh})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != c.ew || b.Dy() != c.eh {
+			t.Errorf("scale to %dx%d: got %v, want %dx%d", c.sw, c.sh, b, c.ew, c.eh)
+		}
+	}
+}
+
+func TestEncodeSharpYUV(t *testing.T) {
+	src := readPNGFixture(t, "saturated.png")
+
+	encodeDecode := func(sharp bool) image.Image {
+		opts := DefaultEncoderOptions(90)
+		opts.UseSharpYUV = sharp
+
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, src, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := DecodeWithOptions(buf.Bytes(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	before, after := psnr(src, encodeDecode(false)), psnr(src, encodeDecode(true))
+	t.Logf("PSNR: %.2f dB -> %.2f dB", before, after)
+
+	if after <= before {
+		t.Error("sharp yuv doesn't improve PSNR:", before, after)
+	}
+}
+
+// testPattern returns an image with every pixel different, alpha is kept above zero
+// so lossless encoding won't touch the RGB values
+func testPattern(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = uint8(x * 7)
+			img.Pix[i+1] = uint8(y * 13)
+			img.Pix[i+2] = uint8(x*y + 50)
+			img.Pix[i+3] = uint8(128 + (x+y)%128)
+		}
+	}
+	return img
+}
+
+func TestEncodeRaw(t *testing.T) {
+	const width, height, padding = 21, 11, 5
+	src := testPattern(width, height)
+
+	for _, layout := range []PixelLayout{LayoutRGB, LayoutBGR, LayoutRGBA, LayoutBGRA, LayoutRGBX, LayoutBGRX} {
+		bpp := layout.BytesPerPixel()
+		stride := width*bpp + padding
+		pix := make([]byte, stride*height)
+
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				s, d := src.Pix[src.PixOffset(x, y):], pix[y*stride+x*bpp:]
+				switch layout {
+				case LayoutRGB, LayoutRGBA, LayoutRGBX:
+					d[0], d[1], d[2] = s[0], s[1], s[2]
+				case LayoutBGR, LayoutBGRA, LayoutBGRX:
+					d[0], d[1], d[2] = s[2], s[1], s[0]
+				}
+				if bpp == 4 {
+					d[3] = s[3]
+				}
+			}
+		}
+
+		opts := DefaultEncoderOptions(100)
+		opts.Lossless = true
+		webp, err := EncodeRaw(pix, layout, width, height, stride, opts)
+		if err != nil {
+			t.Fatal(layout, err)
+		}
+
+		img, err := DecodeWithOptions(webp, nil)
+		if err != nil {
+			t.Fatal(layout, err)
+		}
+
+		p := img.(*image.NRGBA)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				expect := src.NRGBAAt(x, y)
+				if layout != LayoutRGBA && layout != LayoutBGRA {
+					expect.A = 255
+				}
+				if got := p.NRGBAAt(x, y); got != expect {
+					t.Fatal(layout, "pixel not matched at", x, y, got, expect)
+				}
+			}
+		}
+	}
+
+	// RGB under transparent pixels is kept only with Exact
+	pix := []byte{10, 20, 30, 0, 40, 50, 60, 255}
+	webp, err := EncodeRaw(pix, LayoutRGBA, 2, 1, 8, &EncoderOptions{Lossless: true, Exact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := DecodeWithOptions(webp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.(*image.NRGBA).Pix; !bytes.Equal(got, pix) {
+		t.Fatal("transparent pixel not kept:", got)
+	}
+
+	if _, err := EncodeRaw(make([]byte, 10), LayoutRGB, 4, 4, 12, nil); err == nil {
+		t.Error("expect an error on short buffer")
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	const width, height = 19, 9
+	src := testPattern(width, height)
+
+	opts := DefaultEncoderOptions(100)
+	opts.Lossless = true
+	webp, err := EncodeRaw(src.Pix, LayoutRGBA, width, height, src.Stride, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	premul := func(c, a uint8) uint8 { return uint8(uint32(c) * uint32(a) / 255) }
+
+	for _, mode := range []ColorMode{
+		ModeRGB, ModeRGBA, ModeBGR, ModeBGRA, ModeARGB, ModeRGBA4444, ModeRGB565,
+		ModePremulRGBA, ModePremulBGRA, ModePremulARGB, ModePremulRGBA4444,
+	} {
+		pix, w, h, err := DecodeRaw(webp, mode, nil)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		if w != width || h != height || len(pix) != w*h*mode.BytesPerPixel() {
+			t.Fatal(mode, "size not matched", w, h, len(pix))
+		}
+
+		for i := 0; i < w*h; i++ {
+			s, p := src.Pix[i*4:], pix[i*mode.BytesPerPixel():]
+			r, g, b, a := s[0], s[1], s[2], s[3]
+
+			var expect, got [4]uint8
+			switch mode {
+			case ModeRGB:
+				expect, got = [4]uint8{r, g, b}, [4]uint8{p[0], p[1], p[2]}
+			case ModeBGR:
+				expect, got = [4]uint8{r, g, b}, [4]uint8{p[2], p[1], p[0]}
+			case ModeRGBA:
+				expect, got = [4]uint8{r, g, b, a}, [4]uint8{p[0], p[1], p[2], p[3]}
+			case ModeBGRA:
+				expect, got = [4]uint8{r, g, b, a}, [4]uint8{p[2], p[1], p[0], p[3]}
+			case ModeARGB:
+				expect, got = [4]uint8{r, g, b, a}, [4]uint8{p[1], p[2], p[3], p[0]}
+			case ModeRGBA4444:
+				expect = [4]uint8{r >> 4, g >> 4, b >> 4, a >> 4}
+				got = [4]uint8{p[0] >> 4, p[0] & 0xf, p[1] >> 4, p[1] & 0xf}
+			case ModeRGB565:
+				expect = [4]uint8{r >> 3, g >> 2, b >> 3}
+				got = [4]uint8{p[0] >> 3, (p[0]&7)<<3 | p[1]>>5, p[1] & 0x1f}
+			}
+
+			if mode == ModePremulRGBA || mode == ModePremulBGRA || mode == ModePremulARGB || mode == ModePremulRGBA4444 {
+				// premultiplication in libwebp is approximated, so allow a small error
+				expect = [4]uint8{premul(r, a), premul(g, a), premul(b, a), a}
+				switch mode {
+				case ModePremulRGBA:
+					got = [4]uint8{p[0], p[1], p[2], p[3]}
+				case ModePremulBGRA:
+					got = [4]uint8{p[2], p[1], p[0], p[3]}
+				case ModePremulARGB:
+					got = [4]uint8{p[1], p[2], p[3], p[0]}
+				case ModePremulRGBA4444:
+					expect = [4]uint8{expect[0] >> 4, expect[1] >> 4, expect[2] >> 4, a >> 4}
+					got = [4]uint8{p[0] >> 4, p[0] & 0xf, p[1] >> 4, p[1] & 0xf}
+				}
+				for c := range expect {
+					if d := int(expect[c]) - int(got[c]); d < -2 || d > 2 {
+						t.Fatal(mode, "pixel not matched at", i, got, expect)
+					}
+				}
+				continue
+			}
+
+			if got != expect {
+				t.Fatal(mode, "pixel not matched at", i, got, expect)
+			}
+		}
+	}
+
+	if _, _, _, err := DecodeRaw(webp, ColorMode(11), nil); err == nil { // MODE_YUV
+		t.Error("expect an error on yuv mode")
+	}
+}
+
+// makeExif builds a minimal tiff with an extra tag before the orientation tag
+func makeExif(order binary.ByteOrder, orientation int) []byte {
+	p := make([]byte, 8+2+12*2+4)
+	if order == binary.LittleEndian {
+		copy(p, "II")
+	} else {
+		copy(p, "MM")
+	}
+	order.PutUint16(p[2:], 42)
+	order.PutUint32(p[4:], 8)
+	order.PutUint16(p[8:], 2)
+	order.PutUint16(p[10:], 0x010f) // make, ascii
+	order.PutUint16(p[12:], 2)
+	order.PutUint16(p[22:], 0x0112) // orientation, short
+	order.PutUint16(p[24:], 3)
+	order.PutUint32(p[26:], 1)
+	order.PutUint16(p[30:], uint16(orientation))
+	return p
+}
+
+func TestAutoOrient(t *testing.T) {
+	// a b c
+	// d e f
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Pix[i*4], src.Pix[i*4+3] = 'a'+uint8(i), 255
+	}
+
+	expects := map[int]string{
+		1: "abc/def",
+		2: "cba/fed",
+		3: "fed/cba",
+		4: "def/abc",
+		5: "ad/be/cf",
+		6: "da/eb/fc",
+		7: "fc/eb/da",
+		8: "cf/be/ad",
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o, expect := range expects {
+			exif := makeExif(order, o)
+			if ExifOrientation(exif) != o || ExifOrientation(append([]byte("Exif\x00\x00"), exif...)) != o {
+				t.Fatal(order, o, "orientation not matched")
+			}
+
+			opts := DefaultEncoderOptions(100)
+			opts.Lossless = true
+			opts.EXIF = exif
+
+			buf := &bytes.Buffer{}
+			if err := Encode(buf, src, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := DecodeWithOptions(buf.Bytes(), &DecoderOptions{AutoOrient: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, got := img.(*image.NRGBA), ""
+			for y := 0; y < p.Rect.Dy(); y++ {
+				if y > 0 {
+					got += "/"
+				}
+				for x := 0; x < p.Rect.Dx(); x++ {
+					got += string(rune(p.NRGBAAt(x, y).R))
+				}
+			}
+			if got != expect {
+				t.Error(order, o, "got", got, "expect", expect)
+			}
+
+			// re-encode the oriented image without rotating it twice
+			opts.EXIF = ReadChunk(buf.Bytes(), "EXIF")
+			opts.ResetOrientation = true
+			buf.Reset()
+			if err := Encode(buf, img, opts); err != nil {
+				t.Fatal(err)
+			}
+			if o := ExifOrientation(ReadChunk(buf.Bytes(), "EXIF")); o != 1 {
+				t.Error(order, "orientation not reset:", o)
+			}
+		}
+	}
+}
+
+func near(a, b uint8, d int) bool {
+	return int(a)-int(b) <= d && int(b)-int(a) <= d
+}
+
+func TestFlattenAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{255, 0, 0, 128})
+	}
+
+	flat, err := FlattenAlpha(img, color.White)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := flat.RGBAAt(15, 15); !near(c.R, 255, 2) || !near(c.G, 127, 2) || !near(c.B, 127, 2) || c.A != 255 {
+		t.Fatal("unexpected color:", c)
+	}
+
+	// sub-images have a larger stride than their width
+	big := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			big.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 20), G: uint8(y * 20), A: 255})
+		}
+	}
+	sub := big.SubImage(image.Rect(5, 5, 8, 8))
+	if flat, err = FlattenAlpha(sub, color.White); err != nil {
+		t.Fatal(err)
+	}
+	if flat.Bounds() != sub.Bounds() {
+		t.Fatal("unexpected bounds:", flat.Bounds())
+	}
+	for y := 5; y < 8; y++ {
+		for x := 5; x < 8; x++ {
+			if c := flat.RGBAAt(x, y); c != (color.RGBA{uint8(x * 20), uint8(y * 20), 0, 255}) {
+				t.Fatal("unexpected color at", x, y, c)
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, img, &EncoderOptions{Quality: 100, Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := DecodeToJPEGBackground(out, buf.Bytes(), &jpeg.Options{Quality: 95}, color.White); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := decoded.At(8, 8).RGBA()
+	if !near(uint8(r>>8), 255, 6) || !near(uint8(g>>8), 127, 6) || !near(uint8(b>>8), 127, 6) {
+		t.Fatal("unexpected color:", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestEncodeAlphaOptions(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: uint8(x*4 ^ y*4)})
+		}
+	}
+
+	encode := func(quality, filtering int) ([]byte, image.Image) {
+		opts := DefaultEncoderOptions(75)
+		opts.AlphaQuality, opts.AlphaFiltering = quality, filtering
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, img, opts); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), Decode(buf.Bytes())
+	}
+
+	// alpha is lossless at quality 100, whatever the filtering is
+	for _, filtering := range []int{0, 1, 2} {
+		_, decoded := encode(100, filtering)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if _, _, _, a := decoded.At(x, y).RGBA(); uint8(a>>8) != img.NRGBAAt(x, y).A {
+					t.Fatal(filtering, "alpha not matched at", x, y)
+				}
+			}
+		}
+	}
+
+	lossless, _ := encode(100, 1)
+	lossy, _ := encode(0, 1)
+	if len(lossy) >= len(lossless) {
+		t.Fatal("alpha quality doesn't reduce the size:", len(lossy), len(lossless))
+	}
+}
+
+func TestDecodeYCbCrOddSize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 17, 9))
+	for y := 0; y < 9; y++ {
+		for x := 0; x < 17; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 200, G: uint8(x * 15), B: uint8(y * 28), A: uint8(x*10 + y)})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, img, DefaultEncoderOptions(90)); err != nil {
+		t.Fatal(err)
+	}
+
+	nyuva, ok := DecodeYCbCr(buf.Bytes()).(*image.NYCbCrA)
+	if !ok {
+		t.Fatal("expect *image.NYCbCrA")
+	}
+	if nyuva.Bounds() != img.Bounds() || nyuva.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		t.Fatal("unexpected image:", nyuva.Bounds(), nyuva.SubsampleRatio)
+	}
+	// the chroma planes are rounded up
+	if len(nyuva.Cb) < 9*5 || nyuva.CStride < 9 {
+		t.Fatal("unexpected chroma plane:", len(nyuva.Cb), nyuva.CStride)
+	}
+	if a := nyuva.A[nyuva.AOffset(16, 8)]; a != 168 {
+		t.Fatal("unexpected alpha at the last pixel:", a)
+	}
+	if _, _, _, a := nyuva.At(16, 8).RGBA(); a>>8 != 168 {
+		t.Fatal("unexpected alpha at the last pixel:", a>>8)
+	}
+	// chroma is upsampled by the nearest sample rather than libwebp's fancy upsampling
+	if c := color.NRGBAModel.Convert(nyuva.At(16, 8)).(color.NRGBA); !near(c.R, 200, 20) {
+		t.Fatal("unexpected color at the last pixel:", c)
+	}
+
+	flat, err := FlattenAlpha(img, color.Black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := Encode(buf, flat, DefaultEncoderOptions(90)); err != nil {
+		t.Fatal(err)
+	}
+	yuv, ok := DecodeYCbCr(buf.Bytes()).(*image.YCbCr)
+	if !ok {
+		t.Fatal("expect *image.YCbCr for opaque images")
+	}
+	if yuv.Bounds() != img.Bounds() {
+		t.Fatal("unexpected bounds:", yuv.Bounds())
+	}
+}